@@ -0,0 +1,113 @@
+package localtracing
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"hash/fnv"
+	"html/template"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+////////////////////
+// 页面以及静态资源 默认使用内嵌的views目录
+// 开发模式下直接读取磁盘上的文件，文件修改后通知页面刷新
+////////////////////
+
+//go:embed views
+var views embed.FS
+
+// Views 内嵌的页面以及静态资源 路径以views/开头
+var Views fs.FS = views
+
+// ExecuteBinTemplate 渲染内嵌的页面
+func ExecuteBinTemplate(wr io.Writer, name, path string, data interface{}) error {
+	return ExecuteTemplateFS(Views, wr, name, path, data)
+}
+
+// ExecuteTemplateFS 渲染fsys中的页面 每次调用都重新解析
+func ExecuteTemplateFS(fsys fs.FS, wr io.Writer, name, path string, data interface{}) error {
+	tmplBytes, err := fs.ReadFile(fsys, path)
+	if err != nil {
+		return err
+	}
+	tmpl, err := template.New(name).Parse(string(tmplBytes))
+	if err != nil {
+		return err
+	}
+	return tmpl.Execute(wr, data)
+}
+
+const viewWatchInterval = 500 * time.Millisecond
+
+// 开发模式下轮询views目录 文件修改后通知所有订阅的页面
+type viewWatcher struct {
+	dir string
+
+	mu   sync.Mutex
+	subs map[chan string]struct{}
+}
+
+func newViewWatcher(dir string, interval time.Duration) *viewWatcher {
+	w := &viewWatcher{dir: dir, subs: map[chan string]struct{}{}}
+	go w.run(interval)
+	return w
+}
+
+func (w *viewWatcher) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last := w.version()
+	for range ticker.C {
+		if cur := w.version(); cur != last {
+			last = cur
+			w.notify()
+		}
+	}
+}
+
+// 目录下所有文件的名字、大小以及修改时间的摘要
+func (w *viewWatcher) version() uint64 {
+	h := fnv.New64a()
+	filepath.Walk(w.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		fmt.Fprintf(h, "%s %d %d\n", path, info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	return h.Sum64()
+}
+
+func (w *viewWatcher) notify() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for ch := range w.subs {
+		select {
+		case ch <- "reload":
+		default:
+		}
+	}
+}
+
+// 订阅文件修改 ctx结束时取消
+func (w *viewWatcher) Subscribe(ctx context.Context) chan string {
+	ch := make(chan string, 1)
+	w.mu.Lock()
+	w.subs[ch] = struct{}{}
+	w.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		w.mu.Lock()
+		delete(w.subs, ch)
+		w.mu.Unlock()
+	}()
+	return ch
+}
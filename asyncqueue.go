@@ -0,0 +1,99 @@
+package localtracing
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 导出器共用的有界异步队列 由单独的协程批量处理
+// 队列满或者关闭之后写入的数据直接丢弃并计数 不阻塞请求
+type asyncQueue struct {
+	mu     sync.RWMutex // 保证关闭之后不再写入队列
+	closed bool
+	items  chan interface{}
+	stop   chan struct{} // 开始关闭 处理协程等待时需要同时监听
+	done   chan struct{}
+
+	dropped int64
+}
+
+func newAsyncQueue(size int) *asyncQueue {
+	return &asyncQueue{
+		items: make(chan interface{}, size),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+// 加入队列 已满或者已经关闭时丢弃
+func (q *asyncQueue) push(item interface{}) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		q.drop(1)
+		return
+	}
+	select {
+	case q.items <- item:
+	default:
+		q.drop(1)
+	}
+}
+
+func (q *asyncQueue) drop(n int) {
+	atomic.AddInt64(&q.dropped, int64(n))
+}
+
+func (q *asyncQueue) droppedCount() int64 {
+	return atomic.LoadInt64(&q.dropped)
+}
+
+// 在当前协程中处理队列 add处理一条数据 flush每隔interval以及关闭前调用(interval为0时只在关闭前调用)
+// 关闭时处理完队列中剩余的数据后返回
+func (q *asyncQueue) run(interval time.Duration, add func(item interface{}), flush func()) {
+	defer close(q.done)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case item := <-q.items:
+			add(item)
+		case <-tick:
+			flush()
+		case <-q.stop:
+			for {
+				select {
+				case item := <-q.items:
+					add(item)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// 停止写入并等待剩余的数据处理完成 ctx结束时不再等待
+func (q *asyncQueue) shutdown(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.stop)
+	}
+	q.mu.Unlock()
+
+	select {
+	case <-q.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
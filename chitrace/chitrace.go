@@ -0,0 +1,24 @@
+// chi框架适配 基于localtracing.Middleware
+package chitrace
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/wwqdrh/localtracing"
+)
+
+// 返回chi中间件 路由模板在路由匹配完成后从chi.RouteContext中读取
+func Middleware(l *localtracing.LocalTracing) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				rctx := chi.RouteContext(r.Context())
+				if trace := localtracing.FromContext(r.Context()); trace != nil && rctx != nil {
+					trace.SetRoute(rctx.RoutePattern())
+				}
+			}()
+			next.ServeHTTP(w, r)
+		}))
+	}
+}
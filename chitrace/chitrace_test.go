@@ -0,0 +1,35 @@
+package chitrace
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/wwqdrh/localtracing"
+)
+
+func TestChiMiddleware(t *testing.T) {
+	handler, err := localtracing.NewLocaltracing("./log")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := chi.NewRouter()
+	r.Use(Middleware(handler))
+	r.Get("/user/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/user/1", nil)
+	r.ServeHTTP(w, req)
+	if w.Body.String() != "hello" {
+		t.Error("请求处理失败")
+	}
+
+	routes := handler.LatencySnapshot().Routes
+	if len(routes) != 1 || routes[0].Route != "/user/{id}" {
+		t.Error("没有使用路由模板统计")
+	}
+}
@@ -2,16 +2,24 @@ package localtracing
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"runtime"
-	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type localValue = *sync.Map // 每个协程存储值的位置
 
+// goroutineLocal中存储的值 记录创建时间用于过期清理
+type localEntry struct {
+	values  localValue
+	created time.Time
+}
+
 var (
 	goroutineSpace = []byte("goroutine ")
 
@@ -19,33 +27,107 @@ var (
 	// localValue     = sync.Map{} // 每个协程存储值的位置
 )
 
+type traceKey struct{} // 调用树在上下文中的key 不会与用户的string key冲突
+
+// runtime.Stack的缓冲区复用 避免每次获取id都分配内存
+var stackPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 64)
+		return &b
+	},
+}
+
 // GoroutineID 获取当前goroutine的id
+// runtime.Stack的开销较大，同一个调用流程中尽量只获取一次并传递id
+// 请求中可以使用GetContextValueCtx等通过ctx读取中间件缓存的id
 func GoroutineID() uint64 {
-	b := make([]byte, 64)
+	bp := stackPool.Get().(*[]byte)
+	defer stackPool.Put(bp)
+
+	b := *bp
 	b = b[:runtime.Stack(b, false)]
 	// Parse the 4707 out of "goroutine 4707 ["
 	b = bytes.TrimPrefix(b, goroutineSpace)
-	i := bytes.IndexByte(b, ' ')
-	if i < 0 {
-		panic(fmt.Sprintf("No space found in %q", b))
+	var n uint64
+	for i, c := range b {
+		if c == ' ' && i > 0 {
+			return n
+		}
+		if c < '0' || c > '9' {
+			break
+		}
+		n = n*10 + uint64(c-'0')
 	}
-	b = b[:i]
-	n, err := strconv.ParseUint(string(b), 10, 64)
-	if err != nil {
-		panic(fmt.Sprintf("Failed to parse goroutine ID out of %q: %v", b, err))
+	panic(fmt.Sprintf("Failed to parse goroutine ID out of %q", b))
+}
+
+// ctx中请求协程的id 由中间件在请求开始时获取一次 没有时使用GoroutineID
+func goroutineOf(ctx context.Context) uint64 {
+	if trace := FromContext(ctx); trace != nil && trace.goroutine != 0 {
+		return trace.goroutine
 	}
-	return n
+	return GoroutineID()
 }
 
+// 当前协程上下文中的调用树 没有任何协程上下文时不获取协程id
+func activeTrace() *Trace {
+	if atomic.LoadInt64(&localStats.live) == 0 {
+		return nil
+	}
+	return CurrentTrace()
+}
+
+var fnNames = sync.Map{} // pc与函数名的缓存
+
 // 获取指定上一层级调用函数的名字
+// 只取pc不解析文件行号，同一个调用位置的函数名会被缓存
 func FnName(bottom int) string {
-	pc, _, _, ok := runtime.Caller(bottom)
-	if !ok {
+	var pcs [1]uintptr
+	if runtime.Callers(bottom+1, pcs[:]) == 0 {
 		panic("not found caller")
 	}
-	fn := runtime.FuncForPC(pc)
-	name := fn.Name()
-	return name
+	if name, ok := fnNames.Load(pcs[0]); ok {
+		return name.(string)
+	}
+	frame, _ := runtime.CallersFrames(pcs[:]).Next()
+	fnNames.Store(pcs[0], frame.Function)
+	return frame.Function
+}
+
+// 获取协程id对应的上下文 create为true时不存在则创建
+func localOf(id uint64, create bool) localValue {
+	val, ok := goroutineLocal.Load(id)
+	if !ok {
+		if !create {
+			return nil
+		}
+		val = storeLocal(id, &sync.Map{}, false)
+	}
+
+	entry, _ := val.(*localEntry)
+	if entry == nil {
+		return nil
+	}
+	return entry.values
+}
+
+// 保存协程上下文 replace为false时已存在则返回已有的值
+func storeLocal(id uint64, values localValue, replace bool) *localEntry {
+	entry := &localEntry{values: values, created: time.Now()}
+	if replace {
+		// 只有id对应的协程会写入自己的上下文 不存在并发覆盖
+		_, loaded := goroutineLocal.Load(id)
+		goroutineLocal.Store(id, entry)
+		if !loaded {
+			atomic.AddInt64(&localStats.live, 1)
+		}
+	} else if val, loaded := goroutineLocal.LoadOrStore(id, entry); loaded {
+		return val.(*localEntry)
+	} else {
+		atomic.AddInt64(&localStats.live, 1)
+	}
+	startSweeper()
+	return entry
 }
 
 func HasContext() bool {
@@ -55,19 +137,18 @@ func HasContext() bool {
 }
 
 func ClearContext() {
-	id := GoroutineID()
-	goroutineLocal.Delete(id)
+	clearContext(GoroutineID())
 }
 
-func GetContextValue(key string) interface{} {
-	id := GoroutineID()
-	val, ok := goroutineLocal.Load(id)
-	if !ok {
-		return nil
+func clearContext(id uint64) {
+	if _, loaded := goroutineLocal.LoadAndDelete(id); loaded {
+		atomic.AddInt64(&localStats.live, -1)
 	}
+}
 
-	ctx, ok := val.(localValue)
-	if !ok {
+func GetContextValue(key string) interface{} {
+	ctx := localOf(GoroutineID(), false)
+	if ctx == nil {
 		return nil
 	}
 
@@ -80,20 +161,16 @@ func GetContextValue(key string) interface{} {
 
 // 返回当前上下文中所有数据用字符串返回
 func GetContextJson() string {
-	id := GoroutineID()
-	val, ok := goroutineLocal.Load(id)
-	if !ok {
-		return ""
-	}
-
-	ctx, ok := val.(localValue)
-	if !ok {
+	ctx := localOf(GoroutineID(), false)
+	if ctx == nil {
 		return ""
 	}
 
 	values := map[string]interface{}{}
 	ctx.Range(func(key, value interface{}) bool {
-		values[key.(string)] = value
+		if name, ok := key.(string); ok {
+			values[name] = value
+		}
 		return true
 	})
 	bydata, err := json.Marshal(values)
@@ -104,14 +181,117 @@ func GetContextJson() string {
 }
 
 func SetContextValue(key string, value interface{}) error {
-	id := GoroutineID()
-	val, _ := goroutineLocal.LoadOrStore(id, &sync.Map{})
+	return setContextValue(GoroutineID(), key, value)
+}
 
-	ctx, ok := val.(localValue)
-	if !ok {
+// GetContextValueCtx 读取ctx所在请求的上下文 使用中间件缓存的协程id 不调用runtime.Stack
+// ctx中没有调用树时读取当前协程的上下文
+func GetContextValueCtx(ctx context.Context, key string) interface{} {
+	local := localOf(goroutineOf(ctx), false)
+	if local == nil {
+		return nil
+	}
+	val, _ := local.Load(key)
+	return val
+}
+
+// SetContextValueCtx 写入ctx所在请求的上下文 与GetContextValueCtx相同
+func SetContextValueCtx(ctx context.Context, key string, value interface{}) error {
+	return setContextValue(goroutineOf(ctx), key, value)
+}
+
+func setContextValue(id uint64, key string, value interface{}) error {
+	ctx := localOf(id, true)
+	if ctx == nil {
 		return errors.New("localvalue格式错误")
 	}
 
 	ctx.Store(key, value)
 	return nil
 }
+
+// CurrentTrace 获取当前上下文中的调用树 不存在返回nil
+func CurrentTrace() *Trace {
+	return traceOf(GoroutineID())
+}
+
+func traceOf(id uint64) *Trace {
+	ctx := localOf(id, false)
+	if ctx == nil {
+		return nil
+	}
+
+	trace, _ := ctx.Load(traceKey{})
+	res, _ := trace.(*Trace)
+	return res
+}
+
+func setCurrentTrace(trace *Trace) {
+	setTrace(GoroutineID(), trace)
+}
+
+func setTrace(id uint64, trace *Trace) {
+	if ctx := localOf(id, true); ctx != nil {
+		ctx.Store(traceKey{}, trace)
+	}
+}
+
+// Handoff 当前协程的上下文快照 用于交给子协程继续记录
+type Handoff struct {
+	trace  *Trace
+	span   *Span
+	values map[interface{}]interface{}
+}
+
+// Snapshot 获取当前协程上下文的快照
+func Snapshot() *Handoff {
+	res := &Handoff{values: map[interface{}]interface{}{}}
+
+	ctx := localOf(GoroutineID(), false)
+	if ctx == nil {
+		return res
+	}
+	ctx.Range(func(key, value interface{}) bool {
+		if _, ok := key.(traceKey); ok {
+			res.trace = value.(*Trace)
+			res.span = res.trace.currentSpan()
+		} else {
+			res.values[key] = value
+		}
+		return true
+	})
+	return res
+}
+
+// Restore 在子协程中恢复快照 子协程中记录的节点会合并到父协程的调用树中
+// 返回的函数在子协程结束时调用，记录子协程耗时并清理上下文
+func Restore(h *Handoff) func() {
+	ctx := &sync.Map{}
+	for key, value := range h.values {
+		ctx.Store(key, value)
+	}
+
+	var fork *Trace
+	if h.trace != nil {
+		fork = h.trace.fork(h.span)
+		ctx.Store(traceKey{}, fork)
+	}
+	id := GoroutineID()
+	storeLocal(id, ctx, true)
+
+	return func() {
+		if fork != nil {
+			fork.Finish()
+		}
+		clearContext(id)
+	}
+}
+
+// Go 启动子协程并传递当前协程的上下文
+func Go(fn func()) {
+	h := Snapshot()
+	go func() {
+		defer Restore(h)()
+		fn()
+	}()
+}
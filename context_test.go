@@ -1,6 +1,7 @@
 package localtracing
 
 import (
+	"context"
 	"fmt"
 	"sync"
 	"testing"
@@ -69,4 +70,196 @@ func TestFnName(t *testing.T) {
 		time.Sleep(1 * time.Second)
 	}
 	a()
+
+	if name := FnName(1); name != "github.com/wwqdrh/localtracing.TestFnName" {
+		t.Errorf("函数名错误: %s", name)
+	}
+}
+
+func TestGoHandoff(t *testing.T) {
+	wait := sync.WaitGroup{}
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		defer ClearContext()
+
+		trace := NewTrace("GET /handoff")
+		setCurrentTrace(trace)
+		SetContextValue("key", "value")
+
+		done := sync.WaitGroup{}
+		end := trace.StartSpan("parent")
+		for i := 0; i < 2; i++ {
+			done.Add(1)
+			Go(func() {
+				defer done.Done()
+				if val := GetContextValue("key"); val == nil || val.(string) != "value" {
+					t.Error("子协程没有继承上下文数据")
+				}
+				defer CurrentTrace().StartSpan("worker")()
+				time.Sleep(10 * time.Millisecond)
+			})
+		}
+		done.Wait()
+		end()
+		trace.Finish()
+
+		root := trace.Tree()
+		parent := root.Children[0]
+		if len(parent.Children) != 2 {
+			t.Errorf("子协程没有合并到父节点下: %d", len(parent.Children))
+			return
+		}
+		tracks := map[int]bool{}
+		for _, item := range parent.Children {
+			if item.Name != "goroutine" || len(item.Children) != 1 || item.Children[0].Name != "worker" {
+				t.Error("子协程调用树错误")
+			}
+			if item.Children[0].Track != item.Track {
+				t.Error("子节点应该与协程节点在同一track")
+			}
+			tracks[item.Track] = true
+		}
+		if len(tracks) != 2 || tracks[0] {
+			t.Error("每个子协程应该有独立的track")
+		}
+	}()
+	wait.Wait()
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	trace := NewTrace("GET /restore")
+	h := &Handoff{trace: trace, span: trace.root}
+
+	wait := sync.WaitGroup{}
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		end := Restore(h)
+		func() {
+			defer CurrentTrace().StartSpan("child")()
+		}()
+		end()
+		if HasContext() {
+			t.Error("子协程上下文没有清理")
+		}
+	}()
+	wait.Wait()
+
+	root := trace.Tree()
+	if len(root.Children) != 1 || root.Children[0].Children[0].Name != "child" {
+		t.Error("Restore后的节点没有合并")
+	}
+}
+
+// 模拟中间件 在当前协程中保存调用树并缓存协程id
+func requestContext() context.Context {
+	trace := NewTrace("GET /request")
+	trace.goroutine = GoroutineID()
+	setTrace(trace.goroutine, trace)
+	return NewContext(context.Background(), trace)
+}
+
+func TestContextValueCtx(t *testing.T) {
+	wait := sync.WaitGroup{}
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		defer ClearContext()
+		ctx := requestContext()
+		SetContextValue("key", "value")
+
+		// 其他协程通过ctx读写请求的上下文 直接读取只能得到自己的上下文
+		inner := sync.WaitGroup{}
+		inner.Add(1)
+		go func() {
+			defer inner.Done()
+			if GetContextValueCtx(ctx, "key") != "value" {
+				t.Error("通过ctx读取请求上下文失败")
+			}
+			SetContextValueCtx(ctx, "child", 1)
+			if GetContextValue("key") != nil {
+				t.Error("子协程读取到了请求协程的上下文")
+			}
+		}()
+		inner.Wait()
+		if GetContextValue("child") != 1 {
+			t.Error("通过ctx写入请求上下文失败")
+		}
+	}()
+	wait.Wait()
+
+	if GetContextValueCtx(context.Background(), "key") != nil {
+		t.Error("没有调用树时应该读取当前协程的上下文")
+	}
+}
+
+func BenchmarkGoroutineID(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		GoroutineID()
+	}
+}
+
+// stack为每次调用runtime.Stack获取id ctx为通过ctx使用中间件缓存的id
+// b.Run在新的协程中执行 各自准备请求上下文
+func benchmarkCtx(b *testing.B, stack func(), ctx func(context.Context)) {
+	run := func(fn func(context.Context)) func(b *testing.B) {
+		return func(b *testing.B) {
+			defer ClearContext()
+			req := requestContext()
+			SetContextValue("key", "value")
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				fn(req)
+			}
+		}
+	}
+	b.Run("stack", run(func(context.Context) { stack() }))
+	b.Run("ctx", run(ctx))
+}
+
+func BenchmarkSetContextValue(b *testing.B) {
+	benchmarkCtx(b, func() {
+		SetContextValue("key", "value")
+	}, func(ctx context.Context) {
+		SetContextValueCtx(ctx, "key", "value")
+	})
+}
+
+func BenchmarkGetContextValue(b *testing.B) {
+	benchmarkCtx(b, func() {
+		GetContextValue("key")
+	}, func(ctx context.Context) {
+		GetContextValueCtx(ctx, "key")
+	})
+}
+
+func BenchmarkTime(b *testing.B) {
+	handler := &LocalTracing{latency: newLatencyStats()}
+	benchmarkCtx(b, func() {
+		handler.Time()()
+	}, func(ctx context.Context) {
+		_, end := handler.TimeCtx(ctx)
+		end()
+	})
+}
+
+func BenchmarkFnName(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		FnName(1)
+	}
+}
+
+func BenchmarkTimeCtx(b *testing.B) {
+	handler := &LocalTracing{latency: newLatencyStats()}
+	ctx := NewContext(context.Background(), NewTrace("bench"))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, end := handler.TimeCtx(ctx)
+		end()
+	}
 }
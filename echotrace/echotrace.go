@@ -0,0 +1,33 @@
+// echo框架适配 基于localtracing.Middleware
+package echotrace
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/wwqdrh/localtracing"
+)
+
+// 返回echo中间件 路由模板使用c.Path()
+func Middleware(l *localtracing.LocalTracing) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if trace := localtracing.FromContext(r.Context()); trace != nil {
+					trace.SetRoute(c.Path())
+				}
+				origin := c.Response().Writer
+				defer func() { c.Response().Writer = origin }()
+
+				c.SetRequest(r)
+				c.Response().Writer = w
+				// 在中间件内完成错误响应 保证记录的是最终结果
+				// 错误已经交给HTTPErrorHandler处理 不再向外返回 避免重复处理
+				if err := next(c); err != nil {
+					c.Error(err)
+				}
+			})).ServeHTTP(c.Response().Writer, c.Request())
+			return nil
+		}
+	}
+}
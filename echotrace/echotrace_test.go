@@ -0,0 +1,73 @@
+package echotrace
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/wwqdrh/localtracing"
+)
+
+func TestEchoMiddleware(t *testing.T) {
+	handler, err := localtracing.NewLocaltracing("./log")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	e.Use(Middleware(handler))
+	e.GET("/user/:id", func(c echo.Context) error {
+		return c.String(200, "hello")
+	})
+	e.GET("/fail", func(c echo.Context) error {
+		return echo.NewHTTPError(http.StatusBadRequest)
+	})
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/user/1", nil)
+	e.ServeHTTP(w, req)
+	if w.Body.String() != "hello" {
+		t.Error("请求处理失败")
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/fail", nil)
+	e.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("错误响应状态码错误: %d", w.Code)
+	}
+
+	routes := handler.LatencySnapshot().Routes
+	if len(routes) != 2 || routes[1].Route != "/user/:id" {
+		t.Error("没有使用路由模板统计")
+	}
+}
+
+func TestEchoErrorHandledOnce(t *testing.T) {
+	handler, err := localtracing.NewLocaltracing("./log")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	calls := 0
+	e.HTTPErrorHandler = func(err error, c echo.Context) {
+		calls++
+		c.String(http.StatusTeapot, err.Error())
+	}
+	e.Use(Middleware(handler))
+	e.GET("/fail", func(c echo.Context) error {
+		return echo.NewHTTPError(http.StatusBadRequest)
+	})
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/fail", nil)
+	e.ServeHTTP(w, req)
+	if calls != 1 {
+		t.Errorf("错误处理调用了%d次", calls)
+	}
+	if w.Code != http.StatusTeapot {
+		t.Errorf("没有使用自定义的错误响应: %d", w.Code)
+	}
+}
@@ -0,0 +1,292 @@
+package localtracing
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+////////////////////
+// 错误聚合 panic以及Error级别的日志按照规范化的消息和调用栈计算指纹
+// 相同指纹的错误记录次数、首次以及最近出现的时间、最近的请求
+////////////////////
+
+const (
+	errorKindPanic = "panic"
+	errorKindLog   = "log"
+
+	maxErrorGroups  = 1000 // 超出时淘汰最久没有出现的分组
+	maxErrorSamples = 10   // 每个分组保留的最近请求数
+	maxErrorFrames  = 16   // 参与指纹计算的调用栈深度
+)
+
+var ErrErrorGroupNotFound = errors.New("错误分组不存在")
+
+// ErrorGroup 相同指纹的错误
+type ErrorGroup struct {
+	Fingerprint string        `json:"fingerprint"`
+	Kind        string        `json:"kind"`    // panic或者log
+	Type        string        `json:"type"`    // panic值的类型
+	Message     string        `json:"message"` // 规范化之后的消息
+	Location    string        `json:"location"`
+	Stack       []string      `json:"stack"` // 参与指纹计算的函数名
+	Count       uint64        `json:"count"`
+	FirstSeen   time.Time     `json:"first_seen"`
+	LastSeen    time.Time     `json:"last_seen"`
+	Samples     []ErrorSample `json:"samples,omitempty"` // 最近的请求 新的在前
+}
+
+// ErrorSample 分组中的一次错误
+type ErrorSample struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"` // 原始消息
+	TraceID string    `json:"trace_id,omitempty"`
+	PanicID string    `json:"panic_id,omitempty"`
+}
+
+var (
+	// 消息中变化的部分 按顺序替换
+	errorNormalizers = []struct {
+		re   *regexp.Regexp
+		repl string
+	}{
+		{regexp.MustCompile(`"(?:[^"\\]|\\.)*"`), `"?"`},
+		{regexp.MustCompile(`'(?:[^'\\]|\\.)*'`), `'?'`},
+		{regexp.MustCompile(`(?i)\b[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}\b`), "<uuid>"},
+		{regexp.MustCompile(`(?i)\b0x[0-9a-f]+\b`), "<addr>"},
+		{regexp.MustCompile(`(?i)\b[0-9a-f]{16,}\b`), "<hex>"},
+		{regexp.MustCompile(`\d+(\.\d+)?`), "?"},
+	}
+)
+
+// 替换消息中的字符串、id以及数字 使同一类错误得到相同的消息
+func normalizeErrorMessage(msg string) string {
+	for _, item := range errorNormalizers {
+		msg = item.re.ReplaceAllString(msg, item.repl)
+	}
+	return msg
+}
+
+func errorFingerprint(kind, typ, msg string, stack []string) string {
+	h := sha1.New()
+	for _, item := range append([]string{kind, typ, msg}, stack...) {
+		h.Write([]byte(item))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+type errorGroups struct {
+	mu     sync.Mutex
+	groups map[string]*ErrorGroup
+	limit  int
+}
+
+func newErrorGroups(limit int) *errorGroups {
+	return &errorGroups{groups: map[string]*ErrorGroup{}, limit: limit}
+}
+
+func (e *errorGroups) add(kind, typ, msg string, stack []string, sample ErrorSample) string {
+	if e == nil {
+		return ""
+	}
+	pattern := normalizeErrorMessage(msg)
+	fingerprint := errorFingerprint(kind, typ, pattern, stack)
+	sample.Message = msg
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	group, ok := e.groups[fingerprint]
+	if !ok {
+		if len(e.groups) >= e.limit {
+			e.evict()
+		}
+		group = &ErrorGroup{
+			Fingerprint: fingerprint,
+			Kind:        kind,
+			Type:        typ,
+			Message:     pattern,
+			Stack:       stack,
+			FirstSeen:   sample.Time,
+		}
+		if len(stack) > 0 {
+			group.Location = stack[0]
+		}
+		e.groups[fingerprint] = group
+	}
+	group.Count++
+	group.LastSeen = sample.Time
+	group.Samples = append([]ErrorSample{sample}, group.Samples...)
+	if len(group.Samples) > maxErrorSamples {
+		group.Samples = group.Samples[:maxErrorSamples]
+	}
+	return fingerprint
+}
+
+// 淘汰最久没有出现的分组
+func (e *errorGroups) evict() {
+	var oldest *ErrorGroup
+	for _, group := range e.groups {
+		if oldest == nil || group.LastSeen.Before(oldest.LastSeen) {
+			oldest = group
+		}
+	}
+	if oldest != nil {
+		delete(e.groups, oldest.Fingerprint)
+	}
+}
+
+// 记录panic 调用栈只取中间件之前的部分
+func (e *errorGroups) AddPanic(report *PanicReport) string {
+	stack := make([]string, 0, maxErrorFrames)
+	for _, frame := range report.Frames {
+		if strings.HasSuffix(frame.Function, ".(*LocalTracing).LogCallInfo") || len(stack) >= maxErrorFrames {
+			break
+		}
+		stack = append(stack, frame.Function)
+	}
+	return e.add(errorKindPanic, report.Type, report.Value, stack, ErrorSample{
+		Time:    report.Time,
+		TraceID: traceIDString(report.TraceID),
+		PanicID: report.ID,
+	})
+}
+
+// 记录Error级别的日志 调用栈使用日志的调用位置以及zap记录的stacktrace
+func (e *errorGroups) AddLog(ent zapcore.Entry, traceID string) string {
+	stack := stackFunctions(ent.Stack)
+	if len(stack) == 0 && ent.Caller.Function != "" {
+		stack = []string{ent.Caller.Function}
+	}
+	return e.add(errorKindLog, ent.Level.String(), ent.Message, stack, ErrorSample{
+		Time:    ent.Time,
+		TraceID: traceID,
+	})
+}
+
+// 最近出现的在前
+func (e *errorGroups) List() []*ErrorGroup {
+	res := []*ErrorGroup{}
+	if e == nil {
+		return res
+	}
+	e.mu.Lock()
+	for _, group := range e.groups {
+		res = append(res, group.copy(false))
+	}
+	e.mu.Unlock()
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].LastSeen.After(res[j].LastSeen)
+	})
+	return res
+}
+
+func (e *errorGroups) Get(fingerprint string) (*ErrorGroup, error) {
+	if e == nil {
+		return nil, ErrErrorGroupNotFound
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	group, ok := e.groups[fingerprint]
+	if !ok {
+		return nil, ErrErrorGroupNotFound
+	}
+	return group.copy(true), nil
+}
+
+// 列表中不包含调用栈以及请求
+func (g *ErrorGroup) copy(detail bool) *ErrorGroup {
+	res := *g
+	res.Stack, res.Samples = nil, nil
+	if detail {
+		res.Stack = append([]string(nil), g.Stack...)
+		res.Samples = append([]ErrorSample(nil), g.Samples...)
+	}
+	return &res
+}
+
+// zap的stacktrace中的函数名 不含文件行号以及runtime
+func stackFunctions(stack string) []string {
+	res := []string{}
+	for _, line := range strings.Split(stack, "\n") {
+		if line == "" || strings.HasPrefix(line, "\t") || strings.HasPrefix(line, "runtime.") {
+			continue
+		}
+		res = append(res, line)
+		if len(res) >= maxErrorFrames {
+			break
+		}
+	}
+	return res
+}
+
+func traceIDString(id TraceID) string {
+	if !id.IsValid() {
+		return ""
+	}
+	return id.String()
+}
+
+// 包装zap的core Error及以上级别的日志同时记录到错误分组
+type errorCore struct {
+	zapcore.Core
+
+	groups  *errorGroups
+	traceID string // With中携带的trace_id
+}
+
+func (c *errorCore) With(fields []zapcore.Field) zapcore.Core {
+	return &errorCore{
+		Core:    c.Core.With(fields),
+		groups:  c.groups,
+		traceID: traceIDField(fields, c.traceID),
+	}
+}
+
+func (c *errorCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	ce = c.Core.Check(ent, ce)
+	if ent.Level >= zapcore.ErrorLevel {
+		ce = ce.AddCore(ent, &errorRecorder{groups: c.groups, traceID: c.traceID})
+	}
+	return ce
+}
+
+// 只记录错误分组 不输出日志
+type errorRecorder struct {
+	groups  *errorGroups
+	traceID string
+}
+
+func (r *errorRecorder) Enabled(lvl zapcore.Level) bool    { return lvl >= zapcore.ErrorLevel }
+func (r *errorRecorder) With([]zapcore.Field) zapcore.Core { return r }
+func (r *errorRecorder) Sync() error                       { return nil }
+
+func (r *errorRecorder) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	return ce
+}
+
+// 没有trace_id字段时使用请求协程中的调用树
+func (r *errorRecorder) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	traceID := traceIDField(fields, r.traceID)
+	if trace := activeTrace(); traceID == "" && trace != nil {
+		traceID = trace.TraceID().String()
+	}
+	r.groups.AddLog(ent, traceID)
+	return nil
+}
+
+func traceIDField(fields []zapcore.Field, def string) string {
+	for _, field := range fields {
+		if field.Key == "trace_id" && field.Type == zapcore.StringType {
+			def = field.String
+		}
+	}
+	return def
+}
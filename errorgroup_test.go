@@ -0,0 +1,112 @@
+package localtracing
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+func TestNormalizeErrorMessage(t *testing.T) {
+	for msg, expect := range map[string]string{
+		"order 123 not found":                                   "order ? not found",
+		`user "tom" not found`:                                  `user "?" not found`,
+		"index out of range [5] with length 3":                  "index out of range [?] with length ?",
+		"trace 0af7651916cd43dd8448eb211c80319c failed":         "trace <hex> failed",
+		"pointer 0xc000123abc":                                  "pointer <addr>",
+		"id 2f1b7c3e-6a1d-4b7e-9c3f-1a2b3c4d5e6f: timeout 1.5s": "id <uuid>: timeout ?s",
+	} {
+		if res := normalizeErrorMessage(msg); res != expect {
+			t.Errorf("%s 规范化错误: %s", msg, res)
+		}
+	}
+}
+
+func TestErrorGroups(t *testing.T) {
+	mux := newTestHandler()
+	handler, err := NewMonitor(mux, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := handler.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/order/1", "/order/2":
+			panic(fmt.Sprintf("order %s not found", r.URL.Path[7:]))
+		case "/log/1", "/log/2":
+			handler.WithContext(r.Context()).Error("query timeout after " + r.URL.Path[5:] + "s")
+			handler.Warn("slow query")
+		default:
+			w.WriteHeader(503)
+		}
+	}))
+	for _, url := range []string{"/order/1", "/order/2", "/log/1", "/log/2", "/unavailable"} {
+		app.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", url, nil))
+	}
+
+	groups := handler.ErrorGroups()
+	if len(groups) != 2 {
+		t.Fatalf("分组数错误: %d", len(groups))
+	}
+	for _, group := range groups {
+		detail, err := handler.LookupErrorGroup(group.Fingerprint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if detail.Count != 2 || len(detail.Samples) != 2 || detail.Samples[0].TraceID == "" || !detail.FirstSeen.Before(detail.LastSeen) {
+			t.Errorf("分组统计错误: %+v", detail)
+		}
+		switch detail.Kind {
+		case errorKindPanic:
+			if detail.Message != "order ? not found" || detail.Samples[0].Message != "order 2 not found" ||
+				detail.Samples[0].PanicID == "" || detail.Location != "github.com/wwqdrh/localtracing.TestErrorGroups.func1" {
+				t.Errorf("panic分组错误: %+v", detail)
+			}
+		case errorKindLog:
+			if detail.Message != "query timeout after ?s" || detail.Type != "error" ||
+				detail.Location != "github.com/wwqdrh/localtracing.TestErrorGroups.func1" {
+				t.Errorf("日志分组错误: %+v", detail)
+			}
+		}
+	}
+
+	// 监控接口
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/errors?kind=panic", nil))
+	list := struct {
+		Errors []*ErrorGroup `json:"errors"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Errors) != 1 || list.Errors[0].Kind != errorKindPanic || list.Errors[0].Samples != nil {
+		t.Errorf("列表错误: %s", w.Body.String())
+	}
+	for url, code := range map[string]int{
+		"/errors":                               200,
+		"/errors/" + list.Errors[0].Fingerprint: 200,
+		"/errors/0000000000000000":              404,
+		"/view/errors":                          200,
+	} {
+		w = httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		if w.Code != code {
+			t.Errorf("%s 状态码错误: %d", url, w.Code)
+		}
+	}
+}
+
+func TestErrorGroupsEvict(t *testing.T) {
+	groups := newErrorGroups(2)
+	now := time.Now()
+	for i, msg := range []string{"a", "b", "a", "c"} {
+		groups.AddLog(zapcore.Entry{Level: zapcore.ErrorLevel, Message: msg, Time: now.Add(time.Duration(i) * time.Second)}, "")
+	}
+	list := groups.List()
+	if len(list) != 2 || list[0].Message != "c" || list[1].Message != "a" || list[1].Count != 2 {
+		t.Errorf("淘汰错误: %+v", list)
+	}
+}
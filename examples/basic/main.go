@@ -13,6 +13,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/wwqdrh/localtracing"
+	"github.com/wwqdrh/localtracing/gintrace"
 )
 
 type GinHanlderAdapter struct {
@@ -65,7 +66,7 @@ func main() {
 		panic(err)
 	}
 	handler = hand
-	engine.Use(handler.HandlerFunc())
+	engine.Use(gintrace.Middleware(handler))
 
 	// 注册路由函数
 	engine.GET("/random", func(ctx *gin.Context) {
@@ -0,0 +1,38 @@
+package localtracing
+
+import (
+	"context"
+	"time"
+)
+
+////////////////////
+// 调用树导出 请求结束后生成TraceRecord交给各个Exporter
+// Export在请求协程中调用，实现不能阻塞
+////////////////////
+
+// TraceRecord 一个已完成请求的调用树
+type TraceRecord struct {
+	TraceID  TraceID       `json:"trace_id"`
+	ParentID SpanID        `json:"parent_id"` // 上游服务的span id 没有为全0
+	Method   string        `json:"method"`
+	Route    string        `json:"route"`
+	URL      string        `json:"url"`
+	Status   int           `json:"status"`
+	Panic    bool          `json:"panic,omitempty"`
+	PanicID  string        `json:"panic_id,omitempty"` // panic报告的id
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+	Root     *Span         `json:"root"` // 根节点的id即本服务的span id
+}
+
+// Failed 请求是否失败(panic或者5xx)
+func (r *TraceRecord) Failed() bool {
+	return r.Panic || r.Status >= 500
+}
+
+// Exporter 调用树的导出方式
+type Exporter interface {
+	Export(*TraceRecord)
+	// 发送剩余的数据并停止
+	Shutdown(ctx context.Context) error
+}
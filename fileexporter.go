@@ -0,0 +1,133 @@
+package localtracing
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FileExporterConfig 文件导出配置
+type FileExporterConfig struct {
+	Dir         string        // 输出目录 默认./traces
+	Format      ExportFormat  // 默认zipkin
+	ServiceName string        // 默认为程序名
+	QueueSize   int           // 等待写入的最大请求数 默认256
+	MaxFiles    int           // 最多保留的文件数 超出时删除最旧的文件 默认10000 小于0不限制
+	MaxAge      time.Duration // 文件的最长保留时间 默认不限制
+}
+
+// FileExporter 每个请求的调用树写入一个文件 文件名为<trace id>-<span id>.<format>.json
+type FileExporter struct {
+	cfg   FileExporterConfig
+	queue *asyncQueue
+	files []exportedFile // 目录中的文件 旧的在前 只在写入协程中使用
+}
+
+type exportedFile struct {
+	name string
+	time time.Time
+}
+
+func NewFileExporter(cfg FileExporterConfig) (*FileExporter, error) {
+	if cfg.Dir == "" {
+		cfg.Dir = "./traces"
+	}
+	format, err := ParseExportFormat(string(cfg.Format))
+	if err != nil {
+		return nil, err
+	}
+	cfg.Format = format
+	if cfg.ServiceName == "" {
+		cfg.ServiceName = defaultServiceName()
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 256
+	}
+	if cfg.MaxFiles == 0 {
+		cfg.MaxFiles = 10000
+	}
+	if err := os.MkdirAll(cfg.Dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	e := &FileExporter{cfg: cfg, queue: newAsyncQueue(cfg.QueueSize)}
+	// 之前写入的文件也计入保留数量
+	infos, err := ioutil.ReadDir(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasSuffix(info.Name(), ".json") {
+			e.files = append(e.files, exportedFile{name: info.Name(), time: info.ModTime()})
+		}
+	}
+	sort.Slice(e.files, func(i, j int) bool { return e.files[i].time.Before(e.files[j].time) })
+	e.prune(time.Now())
+	go e.run()
+	return e, nil
+}
+
+// Export 加入写入队列 队列已满时丢弃
+func (e *FileExporter) Export(rec *TraceRecord) {
+	e.queue.push(rec)
+}
+
+// Dropped 被丢弃或者写入失败的请求数
+func (e *FileExporter) Dropped() int64 {
+	return e.queue.droppedCount()
+}
+
+// Shutdown 写入队列中剩余的数据
+func (e *FileExporter) Shutdown(ctx context.Context) error {
+	return e.queue.shutdown(ctx)
+}
+
+func (e *FileExporter) run() {
+	e.queue.run(0, func(item interface{}) {
+		if err := e.write(item.(*TraceRecord)); err != nil {
+			e.queue.drop(1)
+		}
+	}, func() {})
+}
+
+// 删除超出数量或者过期的文件
+func (e *FileExporter) prune(now time.Time) {
+	n := 0
+	for ; n < len(e.files); n++ {
+		over := e.cfg.MaxFiles > 0 && len(e.files)-n > e.cfg.MaxFiles
+		expired := e.cfg.MaxAge > 0 && now.Sub(e.files[n].time) > e.cfg.MaxAge
+		if !over && !expired {
+			break
+		}
+		os.Remove(filepath.Join(e.cfg.Dir, e.files[n].name))
+	}
+	e.files = e.files[n:]
+}
+
+func (e *FileExporter) write(rec *TraceRecord) error {
+	name := fmt.Sprintf("%s-%s.%s.json", rec.TraceID, rec.Root.ID, e.cfg.Format)
+	if err := e.create(name, rec); err != nil {
+		return err
+	}
+	now := time.Now()
+	e.files = append(e.files, exportedFile{name: name, time: now})
+	e.prune(now)
+	return nil
+}
+
+func (e *FileExporter) create(name string, rec *TraceRecord) error {
+	f, err := os.Create(filepath.Join(e.cfg.Dir, name))
+	if err != nil {
+		return err
+	}
+	if err := WriteTraces(f, e.cfg.Format, e.cfg.ServiceName, []*TraceRecord{rec}); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,51 @@
+// gin框架适配 基于localtracing.Middleware
+package gintrace
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wwqdrh/localtracing"
+)
+
+// 返回gin中间件 路由模板使用ctx.FullPath()
+func Middleware(l *localtracing.LocalTracing) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		completed := false
+		l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if trace := localtracing.FromContext(r.Context()); trace != nil {
+				trace.SetRoute(ctx.FullPath())
+			}
+			origin := ctx.Writer
+			defer func() { ctx.Writer = origin }()
+
+			ctx.Request = r
+			ctx.Writer = &responseWriter{ResponseWriter: origin, w: w}
+			ctx.Next()
+			completed = true
+		})).ServeHTTP(ctx.Writer, ctx.Request)
+		// 后续的中间件panic时gin会从中断的位置继续执行剩下的handler 已经写入了错误响应 需要中止
+		if !completed {
+			ctx.Abort()
+		}
+	}
+}
+
+// 让gin的写入经过localtracing的ResponseWriter 以便记录状态码与响应大小
+type responseWriter struct {
+	gin.ResponseWriter
+
+	w http.ResponseWriter
+}
+
+func (r *responseWriter) WriteHeader(code int) {
+	r.w.WriteHeader(code)
+}
+
+func (r *responseWriter) Write(b []byte) (int, error) {
+	return r.w.Write(b)
+}
+
+func (r *responseWriter) WriteString(s string) (int, error) {
+	return r.w.Write([]byte(s))
+}
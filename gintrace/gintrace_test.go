@@ -0,0 +1,85 @@
+package gintrace
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/wwqdrh/localtracing"
+)
+
+func TestGinMiddleware(t *testing.T) {
+	r := gin.Default()
+	handler, err := localtracing.NewLocaltracing("./log")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handleB := func() {
+		defer handler.Time()()
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	handleA := func() {
+		defer handler.Time()()
+		time.Sleep(300 * time.Millisecond)
+		handleB()
+		// panic("测试")
+	}
+
+	r.Use(Middleware(handler))
+	r.GET("/heath/:id", func(ctx *gin.Context) {
+		handleA()
+		ctx.String(200, "hello")
+	})
+
+	wait := sync.WaitGroup{}
+	wait.Add(5)
+	for i := 0; i < 5; i++ {
+		go func(i int) {
+			defer wait.Done()
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", fmt.Sprintf("/heath/%d", i), nil)
+			r.ServeHTTP(w, req)
+			fmt.Println(w.Body.String())
+		}(i)
+	}
+	wait.Wait()
+
+	routes := handler.LatencySnapshot().Routes
+	if len(routes) != 1 || routes[0].Route != "/heath/:id" {
+		t.Error("没有使用路由模板统计")
+	}
+}
+
+// 中间件panic之后不再执行后面的handler 响应只包含错误信息
+func TestGinMiddlewarePanic(t *testing.T) {
+	handler, err := localtracing.NewLocaltracing("./log")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := gin.New()
+	handlerRan := false
+	r.Use(Middleware(handler), func(ctx *gin.Context) {
+		panic("middleware")
+	})
+	r.GET("/panic", func(ctx *gin.Context) {
+		handlerRan = true
+		ctx.String(200, "hello")
+	})
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/panic", nil)
+	r.ServeHTTP(w, req)
+	if handlerRan {
+		t.Error("panic之后继续执行了handler")
+	}
+	if w.Code != 500 || w.Body.String() != "found error" {
+		t.Errorf("错误响应错误: %d %s", w.Code, w.Body.String())
+	}
+}
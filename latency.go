@@ -0,0 +1,431 @@
+package localtracing
+
+import (
+	"math"
+	"math/bits"
+	"sort"
+	"sync"
+	"time"
+)
+
+////////////////////
+// 耗时统计 按路由以及Time()函数聚合
+// 使用对数线性分桶的直方图(类似HDR) 桶可以直接相加合并
+// 每个统计项保存最近一小时的数据，按固定时间片滑动
+////////////////////
+
+const (
+	subBucketBits  = 4
+	subBucketCount = 1 << subBucketBits // 每个2的幂区间再细分的桶数 相对误差约6%
+
+	slotDuration = 10 * time.Second
+	slotCount    = int(time.Hour / slotDuration)
+
+	timelineStep = time.Minute // 趋势图每个点的时间间隔
+)
+
+// 对外提供的统计窗口
+var latencyWindows = []struct {
+	name     string
+	duration time.Duration
+}{
+	{"1m", time.Minute},
+	{"5m", 5 * time.Minute},
+	{"15m", 15 * time.Minute},
+	{"1h", time.Hour},
+}
+
+// 直方图 单位为微秒
+type histogram struct {
+	counts map[int]uint64
+	total  uint64
+	max    uint64
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: map[int]uint64{}}
+}
+
+func bucketIndex(v uint64) int {
+	if v < subBucketCount {
+		return int(v)
+	}
+	exp := bits.Len64(v) - subBucketBits - 1
+	return (exp+1)*subBucketCount + int(v>>uint(exp)) - subBucketCount
+}
+
+// 桶内的最大值
+func bucketValue(idx int) uint64 {
+	if idx < subBucketCount {
+		return uint64(idx)
+	}
+	exp := uint(idx/subBucketCount - 1)
+	mant := uint64(idx%subBucketCount + subBucketCount)
+	return (mant+1)<<exp - 1
+}
+
+func (h *histogram) Record(d time.Duration) {
+	v := uint64(0)
+	if d > 0 {
+		v = uint64(d / time.Microsecond)
+	}
+	h.counts[bucketIndex(v)]++
+	h.total++
+	if v > h.max {
+		h.max = v
+	}
+}
+
+func (h *histogram) Merge(other *histogram) {
+	for idx, count := range other.counts {
+		h.counts[idx] += count
+	}
+	h.total += other.total
+	if other.max > h.max {
+		h.max = other.max
+	}
+}
+
+func (h *histogram) Quantile(q float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	target := uint64(math.Ceil(q * float64(h.total)))
+	if target == 0 {
+		target = 1
+	}
+
+	idxs := make([]int, 0, len(h.counts))
+	for idx := range h.counts {
+		idxs = append(idxs, idx)
+	}
+	sort.Ints(idxs)
+
+	var cur uint64
+	for _, idx := range idxs {
+		cur += h.counts[idx]
+		if cur >= target {
+			v := bucketValue(idx)
+			if v > h.max {
+				v = h.max
+			}
+			return time.Duration(v) * time.Microsecond
+		}
+	}
+	return time.Duration(h.max) * time.Microsecond
+}
+
+type slot struct {
+	at     int64 // 时间片编号
+	hist   *histogram
+	errors uint64
+}
+
+// 最近一小时的滑动统计
+type series struct {
+	mu    sync.Mutex
+	slots [slotCount]slot
+}
+
+func slotAt(now time.Time) int64 {
+	return now.UnixNano() / int64(slotDuration)
+}
+
+func (s *series) Record(now time.Time, d time.Duration, failed bool) {
+	at := slotAt(now)
+	cur := &s.slots[at%int64(slotCount)]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cur.at != at || cur.hist == nil {
+		cur.at = at
+		cur.hist = newHistogram()
+		cur.errors = 0
+	}
+	cur.hist.Record(d)
+	if failed {
+		cur.errors++
+	}
+}
+
+// 合并最近window时间内的时间片
+func (s *series) Window(now time.Time, window time.Duration) (*histogram, uint64) {
+	at := slotAt(now)
+	return s.merge(at-int64(window/slotDuration)+1, at)
+}
+
+// 合并编号在[first, last]之间的时间片 超出一小时的部分已被覆盖
+func (s *series) merge(first, last int64) (*histogram, uint64) {
+	res, errors := newHistogram(), uint64(0)
+	if last-first >= int64(slotCount) {
+		first = last - int64(slotCount) + 1
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := first; i <= last; i++ {
+		cur := &s.slots[i%int64(slotCount)]
+		if cur.at != i || cur.hist == nil {
+			continue
+		}
+		res.Merge(cur.hist)
+		errors += cur.errors
+	}
+	return res, errors
+}
+
+// 最近一小时每分钟的统计 最后一个点为当前未结束的一分钟
+func (s *series) Points(now time.Time) []LatencyPoint {
+	perStep := int64(timelineStep / slotDuration)
+	current := slotAt(now) / perStep * perStep
+	n := int64(time.Hour / timelineStep)
+
+	res := make([]LatencyPoint, 0, n)
+	for i := n - 1; i >= 0; i-- {
+		first := current - i*perStep
+		start := time.Unix(0, first*int64(slotDuration))
+		elapsed := timelineStep
+		if i == 0 {
+			elapsed = now.Sub(start)
+			if elapsed < time.Second {
+				elapsed = time.Second
+			}
+		}
+
+		hist, errors := s.merge(first, first+perStep-1)
+		point := LatencyPoint{
+			Time:   start,
+			Count:  hist.total,
+			Errors: errors,
+			Rate:   float64(hist.total) / elapsed.Seconds(),
+			P50:    durationMs(hist.Quantile(0.5)),
+			P99:    durationMs(hist.Quantile(0.99)),
+		}
+		if hist.total > 0 {
+			point.ErrorRate = float64(errors) / float64(hist.total)
+		}
+		res = append(res, point)
+	}
+	return res
+}
+
+func (s *series) Snapshot(now time.Time) map[string]LatencyWindow {
+	res := make(map[string]LatencyWindow, len(latencyWindows))
+	for _, item := range latencyWindows {
+		hist, errors := s.Window(now, item.duration)
+		window := LatencyWindow{
+			Count:  hist.total,
+			Errors: errors,
+			Rate:   float64(hist.total) / item.duration.Seconds(),
+			P50:    durationMs(hist.Quantile(0.5)),
+			P90:    durationMs(hist.Quantile(0.9)),
+			P99:    durationMs(hist.Quantile(0.99)),
+			P999:   durationMs(hist.Quantile(0.999)),
+			Max:    durationMs(time.Duration(hist.max) * time.Microsecond),
+		}
+		if hist.total > 0 {
+			window.ErrorRate = float64(errors) / float64(hist.total)
+		}
+		res[item.name] = window
+	}
+	return res
+}
+
+type routeKey struct {
+	method string
+	route  string
+}
+
+// 所有路由以及Time()函数的耗时统计
+type latencyStats struct {
+	mu     sync.RWMutex
+	routes map[routeKey]*series
+	funcs  map[string]*series
+}
+
+func newLatencyStats() *latencyStats {
+	return &latencyStats{
+		routes: map[routeKey]*series{},
+		funcs:  map[string]*series{},
+	}
+}
+
+func (l *latencyStats) routeSeries(key routeKey) *series {
+	l.mu.RLock()
+	s, ok := l.routes[key]
+	l.mu.RUnlock()
+	if ok {
+		return s
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if s, ok = l.routes[key]; !ok {
+		s = &series{}
+		l.routes[key] = s
+	}
+	return s
+}
+
+func (l *latencyStats) funcSeries(name string) *series {
+	l.mu.RLock()
+	s, ok := l.funcs[name]
+	l.mu.RUnlock()
+	if ok {
+		return s
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if s, ok = l.funcs[name]; !ok {
+		s = &series{}
+		l.funcs[name] = s
+	}
+	return s
+}
+
+func (l *latencyStats) ObserveRoute(method, route string, d time.Duration, failed bool) {
+	if l == nil {
+		return
+	}
+	l.routeSeries(routeKey{method: method, route: route}).Record(time.Now(), d, failed)
+}
+
+func (l *latencyStats) ObserveFunc(name string, d time.Duration) {
+	if l == nil {
+		return
+	}
+	l.funcSeries(name).Record(time.Now(), d, false)
+}
+
+// LatencyWindow 一个时间窗口内的统计 耗时单位为毫秒
+type LatencyWindow struct {
+	Count     uint64  `json:"count"`
+	Errors    uint64  `json:"errors"`
+	ErrorRate float64 `json:"error_rate"`
+	Rate      float64 `json:"rate"` // 每秒请求数
+	P50       float64 `json:"p50"`
+	P90       float64 `json:"p90"`
+	P99       float64 `json:"p99"`
+	P999      float64 `json:"p999"`
+	Max       float64 `json:"max"`
+}
+
+// LatencyPoint 趋势图中的一个点 耗时单位为毫秒
+type LatencyPoint struct {
+	Time      time.Time `json:"time"`
+	Count     uint64    `json:"count"`
+	Errors    uint64    `json:"errors"`
+	ErrorRate float64   `json:"error_rate"`
+	Rate      float64   `json:"rate"`
+	P50       float64   `json:"p50"`
+	P99       float64   `json:"p99"`
+}
+
+type RouteTimeline struct {
+	Method string         `json:"method"`
+	Route  string         `json:"route"`
+	Points []LatencyPoint `json:"points"`
+}
+
+// LatencyTimeline 路由最近一小时每分钟的请求数、错误率以及耗时
+type LatencyTimeline struct {
+	Time   time.Time       `json:"time"`
+	Step   float64         `json:"step"` // 每个点的间隔 单位为秒
+	Routes []RouteTimeline `json:"routes"`
+}
+
+type RouteLatency struct {
+	Method  string                   `json:"method"`
+	Route   string                   `json:"route"`
+	Windows map[string]LatencyWindow `json:"windows"`
+}
+
+type FuncLatency struct {
+	Name    string                   `json:"name"`
+	Windows map[string]LatencyWindow `json:"windows"`
+}
+
+type LatencySnapshot struct {
+	Time   time.Time      `json:"time"`
+	Routes []RouteLatency `json:"routes"`
+	Funcs  []FuncLatency  `json:"funcs"`
+}
+
+func (l *latencyStats) Snapshot() *LatencySnapshot {
+	now := time.Now()
+	res := &LatencySnapshot{
+		Time:   now,
+		Routes: []RouteLatency{},
+		Funcs:  []FuncLatency{},
+	}
+	if l == nil {
+		return res
+	}
+
+	l.mu.RLock()
+	routes := make(map[routeKey]*series, len(l.routes))
+	for key, s := range l.routes {
+		routes[key] = s
+	}
+	funcs := make(map[string]*series, len(l.funcs))
+	for name, s := range l.funcs {
+		funcs[name] = s
+	}
+	l.mu.RUnlock()
+
+	for key, s := range routes {
+		res.Routes = append(res.Routes, RouteLatency{
+			Method:  key.method,
+			Route:   key.route,
+			Windows: s.Snapshot(now),
+		})
+	}
+	for name, s := range funcs {
+		res.Funcs = append(res.Funcs, FuncLatency{
+			Name:    name,
+			Windows: s.Snapshot(now),
+		})
+	}
+	sort.Slice(res.Routes, func(i, j int) bool {
+		if res.Routes[i].Route != res.Routes[j].Route {
+			return res.Routes[i].Route < res.Routes[j].Route
+		}
+		return res.Routes[i].Method < res.Routes[j].Method
+	})
+	sort.Slice(res.Funcs, func(i, j int) bool {
+		return res.Funcs[i].Name < res.Funcs[j].Name
+	})
+	return res
+}
+
+func (l *latencyStats) Timeline() *LatencyTimeline {
+	now := time.Now()
+	res := &LatencyTimeline{
+		Time:   now,
+		Step:   timelineStep.Seconds(),
+		Routes: []RouteTimeline{},
+	}
+	if l == nil {
+		return res
+	}
+
+	l.mu.RLock()
+	routes := make(map[routeKey]*series, len(l.routes))
+	for key, s := range l.routes {
+		routes[key] = s
+	}
+	l.mu.RUnlock()
+
+	for key, s := range routes {
+		res.Routes = append(res.Routes, RouteTimeline{Method: key.method, Route: key.route, Points: s.Points(now)})
+	}
+
+	sort.Slice(res.Routes, func(i, j int) bool {
+		if res.Routes[i].Route != res.Routes[j].Route {
+			return res.Routes[i].Route < res.Routes[j].Route
+		}
+		return res.Routes[i].Method < res.Routes[j].Method
+	})
+	return res
+}
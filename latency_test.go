@@ -0,0 +1,108 @@
+package localtracing
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucketIndex(t *testing.T) {
+	for _, v := range []uint64{0, 1, 15, 16, 17, 31, 32, 33, 1000, 123456, 1 << 40} {
+		idx := bucketIndex(v)
+		if bucketValue(idx) < v {
+			t.Errorf("%d 的桶上限过小: %d", v, bucketValue(idx))
+		}
+		if idx > 0 && bucketValue(idx-1) >= v {
+			t.Errorf("%d 落入了错误的桶", v)
+		}
+	}
+}
+
+func TestHistogramQuantile(t *testing.T) {
+	h := newHistogram()
+	for i := 1; i <= 1000; i++ {
+		h.Record(time.Duration(i) * time.Millisecond)
+	}
+
+	check := func(q float64, want time.Duration) {
+		got := h.Quantile(q)
+		if diff := float64(got-want) / float64(want); diff < -0.07 || diff > 0.07 {
+			t.Errorf("p%v 误差过大: got %v want %v", q*100, got, want)
+		}
+	}
+	check(0.5, 500*time.Millisecond)
+	check(0.9, 900*time.Millisecond)
+	check(0.99, 990*time.Millisecond)
+	check(0.999, 999*time.Millisecond)
+
+	other := newHistogram()
+	other.Record(2 * time.Second)
+	h.Merge(other)
+	if h.total != 1001 || h.Quantile(1) != 2*time.Second {
+		t.Error("直方图合并失败")
+	}
+}
+
+func TestSeriesWindow(t *testing.T) {
+	s := &series{}
+	now := time.Now()
+	s.Record(now.Add(-30*time.Minute), time.Second, true)
+	s.Record(now, 10*time.Millisecond, false)
+	s.Record(now, 20*time.Millisecond, true)
+
+	hist, errors := s.Window(now, time.Minute)
+	if hist.total != 2 || errors != 1 {
+		t.Errorf("1分钟窗口统计错误: count=%d errors=%d", hist.total, errors)
+	}
+	hist, errors = s.Window(now, time.Hour)
+	if hist.total != 3 || errors != 2 {
+		t.Errorf("1小时窗口统计错误: count=%d errors=%d", hist.total, errors)
+	}
+
+	// 超过一小时的时间片会被覆盖
+	s.Record(now.Add(time.Hour), time.Millisecond, false)
+	if hist, _ := s.Window(now.Add(time.Hour), time.Minute); hist.total != 1 {
+		t.Error("过期时间片没有被重置")
+	}
+}
+
+func TestSeriesPoints(t *testing.T) {
+	s := &series{}
+	now := time.Now()
+	s.Record(now.Add(-30*time.Minute), time.Second, true)
+	s.Record(now, 10*time.Millisecond, false)
+	s.Record(now, 20*time.Millisecond, true)
+
+	points := s.Points(now)
+	if len(points) != 60 {
+		t.Fatalf("点的数量错误: %d", len(points))
+	}
+	last := points[59]
+	if last.Count != 2 || last.Errors != 1 || last.ErrorRate != 0.5 || last.P99 < 19 || last.Time.After(now) {
+		t.Errorf("当前分钟统计错误: %+v", last)
+	}
+	if points[29].Count != 1 || points[29].P50 < 900 || points[0].Count != 0 {
+		t.Errorf("30分钟前统计错误: %+v", points[29])
+	}
+	if !points[1].Time.Equal(points[0].Time.Add(time.Minute)) {
+		t.Error("点的时间间隔错误")
+	}
+}
+
+func TestLatencySnapshot(t *testing.T) {
+	stats := newLatencyStats()
+	stats.ObserveRoute("GET", "/heath", 10*time.Millisecond, false)
+	stats.ObserveRoute("GET", "/heath", 30*time.Millisecond, true)
+	stats.ObserveFunc("handleA", 5*time.Millisecond)
+
+	snapshot := stats.Snapshot()
+	if len(snapshot.Routes) != 1 || len(snapshot.Funcs) != 1 {
+		t.Fatal("统计项数量错误")
+	}
+	window := snapshot.Routes[0].Windows["1m"]
+	if window.Count != 2 || window.ErrorRate != 0.5 {
+		t.Errorf("路由统计错误: %+v", window)
+	}
+	if window.P99 < 29 || window.P99 > 31 {
+		t.Errorf("p99错误: %v", window.P99)
+	}
+}
@@ -4,22 +4,22 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
 	"os/signal"
 	"path"
-	"runtime"
-	"strings"
 	"syscall"
 	"time"
 
-	"github.com/gin-gonic/gin"
 	"github.com/hpcloud/tail"
-	"github.com/wwqdrh/logger"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
 var (
+	ErrTraceNotFound = errors.New("trace不存在")
+
 	Tracing *LocalTracing
 	// 默认日志文件
 	baseLog = "base.log"
@@ -29,16 +29,51 @@ type LocalTracing struct {
 	*zap.Logger
 
 	LogDir string
+
+	latency   *latencyStats // 路由以及函数的耗时统计
+	exporters []Exporter    // 请求结束后导出调用树
+	traces    *traceStore   // 最近请求的调用树
+	metrics   *metrics      // Prometheus指标
+	statsd    *StatsDEmitter
+	errors    *errorGroups // panic以及Error级别日志的分组
+	panics    *panicStore  // panic报告
+	access    *zap.Logger  // 访问日志 不参与错误分组
+	service   string
+
+	panicRenderer PanicRenderer // panic时的响应
+	repanic       bool          // 记录之后重新panic
+	routeResolver RouteResolver // 框架没有设置路由模板时使用
 }
 
-func NewLocaltracing(logDir string) (*LocalTracing, error) {
+func NewLocaltracing(logDir string, opts ...Option) (*LocalTracing, error) {
+	opt := newOptions(opts)
 	if ok, _ := PathExists(logDir); !ok {
 		_ = os.MkdirAll(logDir, os.ModePerm)
 	}
 
+	base, err := newLogger(logDir, opt.log)
+	if err != nil {
+		return nil, err
+	}
+	groups := newErrorGroups(maxErrorGroups)
 	handler := &LocalTracing{
-		Logger: logger.NewLogger(logger.WithColor(true), logger.WithLogPath(path.Join(logDir, baseLog))),
-		LogDir: logDir,
+		Logger: base.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+			return &errorCore{Core: &traceCore{Core: core}, groups: groups}
+		})),
+		LogDir:    logDir,
+		latency:   newLatencyStats(),
+		exporters: opt.exporters,
+		traces:    newTraceStore(opt.traceSize, opt.traceBytes),
+		metrics:   newMetrics(),
+		statsd:    opt.statsd,
+		errors:    groups,
+		panics:    newPanicStore(path.Join(logDir, panicDir), opt.panicKeep, opt.panicMaxAge),
+		access:    base,
+		service:   opt.serviceName,
+
+		panicRenderer: opt.panicRenderer,
+		repanic:       opt.repanic,
+		routeResolver: opt.routeResolver,
 	}
 	go func() {
 		c1 := make(chan os.Signal, 1)
@@ -50,79 +85,303 @@ func NewLocaltracing(logDir string) (*LocalTracing, error) {
 	return handler, nil
 }
 
-func (l *LocalTracing) HandlerFunc() gin.HandlerFunc {
-	return func(ctx *gin.Context) {
-		defer ClearContext() // 清除当前上下文
+// net/http中间件 记录请求的调用树、耗时以及异常
+// gin、echo、chi等框架的适配见gintrace、echotrace、chitrace子包
+func (l *LocalTracing) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 整个请求只获取一次协程id
+		id := GoroutineID()
+		defer clearContext(id) // 清除当前上下文
+		defer l.metrics.StartRequest()()
+
+		trace := NewTrace(fmt.Sprintf("%s %s", r.Method, r.URL.Path))
+		trace.extract(r.Header)
+		w.Header().Set(TraceresponseHeader, trace.Traceparent())
+		trace.goroutine = id
+		setTrace(id, trace)
+		r = r.WithContext(NewContext(r.Context(), trace))
+		rw := newResponseRecorder(w, time.Now())
+		report := l.LogCallInfo(next, rw, r)
+		started := rw.Written()
+		if report != nil && !l.repanic {
+			l.renderPanic(rw, r, report)
+		}
+		trace.Finish()
 
-		start := time.Now()
-		errField := l.LogCallInfo(ctx)
+		status := rw.Status()
+		route := l.route(r, trace.Route(), status)
+		l.latency.ObserveRoute(r.Method, route, trace.Duration(), report != nil || status >= 500)
+		l.metrics.ObserveRequest(r.Method, route, status, trace.Duration(), report != nil)
+		l.statsd.Request(r.Method, route, status, trace.Duration())
+		tree := trace.Tree()
+		rec := &TraceRecord{
+			TraceID:  trace.TraceID(),
+			ParentID: trace.ParentSpanID(),
+			Method:   r.Method,
+			Route:    route,
+			URL:      r.URL.RequestURI(),
+			Status:   status,
+			Panic:    report != nil,
+			Start:    trace.start,
+			Duration: trace.Duration(),
+			Root:     tree,
+		}
+		if report != nil {
+			rec.PanicID = report.ID
+		}
+		l.export(rec)
 		fields := []zap.Field{
-			zap.String("method", ctx.Request.Method),
-			zap.String("host", ctx.Request.Host),
-			zap.String("url", fmt.Sprintf("%s %s", ctx.Request.RequestURI, ctx.Request.Proto)),
-			zap.String("remote", ctx.Request.RemoteAddr),
-			zap.String("call", fmt.Sprintf("%s %v", GetContextJson(), time.Since(start))),
+			zap.String("trace_id", trace.TraceID().String()),
+			zap.String("span_id", trace.SpanID().String()),
+			zap.String("method", r.Method),
+			zap.String("host", r.Host),
+			zap.String("route", route),
+			zap.String("url", fmt.Sprintf("%s %s", r.RequestURI, r.Proto)),
+			zap.String("remote", r.RemoteAddr),
+			zap.Int("status", status),
+			zap.Int("size", rw.Size()),
+			zap.Float64("ttfb_ms", durationMs(rw.FirstByte())),
+			zap.Object("call", tree),
 		}
-		if errField != nil {
+		switch {
+		case report != nil:
 			fields = append(fields,
-				zap.Any("exception", errField),
+				zap.Object("exception", report),
+				zap.Bool("response_started", started),
 				zap.Error(errors.New("crash")),
-				zap.String("status", "Internal Servre Error"),
 			)
-			l.Logger.Error("request:", fields...)
-			ctx.String(500, "found error")
-		} else {
-			fields = append(fields,
-				zap.String("status", "Success"),
-			)
-			l.Info("request:", fields...)
+			l.accessLogger().Error("request:", fields...)
+		case status >= 500:
+			l.accessLogger().Error("request:", fields...)
+		case status >= 400:
+			l.accessLogger().Warn("request:", fields...)
+		default:
+			l.accessLogger().Info("request:", fields...)
+		}
+		if report != nil && l.repanic {
+			panic(report.value)
 		}
+		// 响应已经开始写入 中断连接 避免客户端把不完整的响应当作成功
+		if report != nil && started {
+			panic(http.ErrAbortHandler)
+		}
+	})
+}
+
+// 统计使用的路由 优先使用框架设置的路由模板 其次为WithRouteResolver
+// 都没有时404记为unmatched 其他请求记为unrouted
+func (l *LocalTracing) route(r *http.Request, route string, status int) string {
+	if route == "" && l.routeResolver != nil {
+		route = l.routeResolver(r)
+	}
+	if route != "" {
+		return route
+	}
+	// 不能使用路径 每个id都会成为单独的路由 统计的数量没有上限
+	if status == http.StatusNotFound {
+		return "unmatched"
+	}
+	return "unrouted"
+}
+
+// panic时写入错误响应 响应已经开始写入时不能再修改状态码 由中间件中断连接
+func (l *LocalTracing) renderPanic(rw *responseRecorder, r *http.Request, report *PanicReport) {
+	if rw.Written() {
+		return
+	}
+	// handler设置的长度、压缩方式不适用于错误响应
+	rw.Header().Del("Content-Length")
+	rw.Header().Del("Content-Encoding")
+
+	render := l.panicRenderer
+	if render == nil {
+		render = TextPanicRenderer
+	}
+	render(rw, r, report)
+	if !rw.Written() {
+		rw.WriteHeader(http.StatusInternalServerError)
 	}
 }
 
-// 执行next并处理异常
-func (l *LocalTracing) LogCallInfo(ctx *gin.Context) (res *zapcore.Field) {
+func (l *LocalTracing) export(rec *TraceRecord) {
+	l.traces.Add(rec)
+	for _, e := range l.exporters {
+		e.Export(rec)
+	}
+}
+
+// 执行next并处理异常 发生panic时返回报告并写入LogDir/panics
+// http.ErrAbortHandler用于主动中断连接 不是异常 直接交给net/http处理
+func (l *LocalTracing) LogCallInfo(next http.Handler, w http.ResponseWriter, r *http.Request) (res *PanicReport) {
 	defer func() {
 		if err := recover(); err != nil {
-			defer func() { recover() }()
-			switch err.(type) {
-			default:
-				dep := 0
-				size := 10
-				arr := make([]string, 0, size)
-				for i := 1; i < size; i++ {
-					_, file, line, ok := runtime.Caller(i)
-					if !ok {
-						break
-					}
-					if strings.Contains(file, "/runtime/") || strings.Contains(file, "/reflect/") {
-						continue
-					}
-					arr = append(arr, fmt.Sprintf("%s:%d", file, line))
-					dep++
-				}
-				field := zap.String("stack", strings.Join(arr, " <- "))
-				res = &field
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+			res = newPanicReport(err, 1)
+			res.Method = r.Method
+			res.URL = r.URL.RequestURI()
+			res.withTrace(FromContext(r.Context()))
+			l.errors.AddPanic(res)
+			if serr := l.panics.Save(res); serr != nil {
+				l.Warn("save panic report:", zap.Error(serr))
 			}
 		}
 	}()
-	ctx.Next()
+	next.ServeHTTP(w, r)
 	return nil
 }
 
+// 访问日志 panic已经单独分组 不再作为Error日志重复记录
+func (l *LocalTracing) accessLogger() *zap.Logger {
+	if l.access != nil {
+		return l.access
+	}
+	return l.Logger
+}
+
+// 最近的panic报告 新的在前 不含调用栈以及调用树
+func (l *LocalTracing) PanicReports() ([]*PanicReport, error) {
+	return l.panics.List(panicListLimit), nil
+}
+
+// 按照指纹聚合的panic以及Error级别日志 最近出现的在前
+func (l *LocalTracing) ErrorGroups() []*ErrorGroup {
+	return l.errors.List()
+}
+
+// 错误分组的详情 包括调用栈以及最近的请求
+func (l *LocalTracing) LookupErrorGroup(fingerprint string) (*ErrorGroup, error) {
+	return l.errors.Get(fingerprint)
+}
+
+// 读取完整的panic报告
+func (l *LocalTracing) PanicReport(id string) (*PanicReport, error) {
+	return l.panics.Get(id)
+}
+
 // time时间
-// 设置当前上下文的函数名字以及执行时间
+// 在当前请求的调用树中记录函数的执行时间
+// 不在请求中时退化为设置当前上下文的函数名字以及执行时间
 func (l *LocalTracing) Time() func() {
 	start := time.Now()
 	fnname := FnName(2)
+	id := GoroutineID()
+	if trace := traceOf(id); trace != nil {
+		end := trace.StartSpan(fnname)
+		return func() {
+			end()
+			l.observeFunc(fnname, time.Since(start))
+		}
+	}
 	return func() {
-		SetContextValue(fnname, fmt.Sprintf("%dms", int(time.Since(start).Milliseconds())))
+		setContextValue(id, fnname, fmt.Sprintf("%dms", int(time.Since(start).Milliseconds())))
+		l.observeFunc(fnname, time.Since(start))
+	}
+}
+
+// Time的context版本 返回的ctx携带当前节点，传给下层调用即可记录嵌套关系
+//
+//	ctx, end := handler.TimeCtx(ctx)
+//	defer end()
+func (l *LocalTracing) TimeCtx(ctx context.Context) (context.Context, func()) {
+	start := time.Now()
+	fnname := FnName(2)
+	ctx, end := StartSpan(ctx, fnname)
+	return ctx, func() {
+		end()
+		l.observeFunc(fnname, time.Since(start))
+	}
+}
+
+func (l *LocalTracing) observeFunc(name string, d time.Duration) {
+	l.latency.ObserveFunc(name, d)
+	l.metrics.ObserveSpan(name, d)
+	l.statsd.Span(name, d)
+}
+
+// 返回携带trace_id、span_id的logger 用于记录与请求关联的日志
+// ctx中没有调用树时使用当前协程上下文中的调用树
+func (l *LocalTracing) WithContext(ctx context.Context) *zap.Logger {
+	trace, span := spanFromContext(ctx)
+	if trace == nil {
+		return l.Logger
+	}
+	spanID := trace.SpanID()
+	if span != nil {
+		spanID = span.ID
+	}
+	return l.Logger.With(
+		zap.String("trace_id", trace.TraceID().String()),
+		zap.String("span_id", spanID.String()),
+	)
+}
+
+// 路由以及Time()函数的耗时分布
+func (l *LocalTracing) LatencySnapshot() *LatencySnapshot {
+	return l.latency.Snapshot()
+}
+
+// 路由最近一小时每分钟的请求数、错误率以及耗时
+func (l *LocalTracing) LatencyTimeline() *LatencyTimeline {
+	return l.latency.Timeline()
+}
+
+// 最近请求的调用树 新的在前
+func (l *LocalTracing) RecentTraces() []*TraceRecord {
+	return l.traces.List()
+}
+
+// 最近请求中trace id对应的调用树
+func (l *LocalTracing) LookupTrace(id TraceID) []*TraceRecord {
+	return l.traces.Get(id)
+}
+
+// 最近请求中满足条件的调用树 新的在前
+func (l *LocalTracing) FindTraces(f TraceFilter) []*TraceRecord {
+	return l.traces.Find(&f)
+}
+
+// 最近请求缓冲区的使用情况
+func (l *LocalTracing) TraceStoreStats() TraceStoreStats {
+	return l.traces.Stats()
+}
+
+// ChromeTrace 将请求的调用树写为Chrome Trace Event JSON 可以在chrome://tracing或者Perfetto中打开
+func (l *LocalTracing) ChromeTrace(w io.Writer, id TraceID) error {
+	recs := l.LookupTrace(id)
+	if len(recs) == 0 {
+		return ErrTraceNotFound
+	}
+	return WriteTraces(w, FormatChrome, l.service, recs)
+}
+
+// WriteMetrics 以Prometheus文本格式写入请求、函数耗时以及自身的运行指标
+func (l *LocalTracing) WriteMetrics(w io.Writer) error {
+	return l.metrics.Expose(w)
+}
+
+// Shutdown 停止exporter并同步日志 程序退出前调用以免丢失未发送的调用树
+func (l *LocalTracing) Shutdown(ctx context.Context) error {
+	var res error
+	for _, e := range l.exporters {
+		if err := e.Shutdown(ctx); err != nil && res == nil {
+			res = err
+		}
+	}
+	if l.statsd != nil {
+		if err := l.statsd.Shutdown(ctx); err != nil && res == nil {
+			res = err
+		}
 	}
+	l.Sync()
+	return res
 }
 
 // 每一个要读取的file可能由多个ws连接， 要复用则包装tails，并加上一系列channel
 func (l *LocalTracing) TailLog(fileName string, ctx context.Context) chan string {
 	cur := make(chan string, 1000)
+	l.metrics.TrackTail(ctx)
 	if val, ok := tailHandler[fileName]; ok {
 		val.chs = append(val.chs, connNode{
 			ch:  cur,
@@ -189,6 +448,7 @@ func (l *LocalTracing) TailLog(fileName string, ctx context.Context) chan string
 					continue
 				case item.ch <- line.Text: // TODO 有可能是close channel 需要加上判断
 				default:
+					l.metrics.DropLine()
 				}
 			}
 		}
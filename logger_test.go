@@ -4,15 +4,13 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"sync"
 	"testing"
 	"time"
-
-	"github.com/gin-gonic/gin"
 )
 
 func TestLocalTracingMiddleware(t *testing.T) {
-	r := gin.Default()
 	handler, err := NewLocaltracing("./log")
 	if err != nil {
 		t.Fatal(err)
@@ -30,11 +28,13 @@ func TestLocalTracingMiddleware(t *testing.T) {
 		// panic("测试")
 	}
 
-	r.Use(handler.HandlerFunc())
-	r.GET("/heath", func(ctx *gin.Context) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/heath", func(w http.ResponseWriter, r *http.Request) {
+		CurrentTrace().SetRoute("/heath")
 		handleA()
-		ctx.String(200, "hello")
+		w.Write([]byte("hello"))
 	})
+	r := handler.Middleware(mux)
 
 	wait := sync.WaitGroup{}
 	wait.Add(5)
@@ -48,4 +48,78 @@ func TestLocalTracingMiddleware(t *testing.T) {
 		}()
 	}
 	wait.Wait()
+
+	routes := handler.LatencySnapshot().Routes
+	if len(routes) != 1 || routes[0].Route != "/heath" || routes[0].Windows["1m"].Count != 5 {
+		t.Error("路由耗时统计错误")
+	}
+}
+
+func TestMiddlewarePanic(t *testing.T) {
+	handler, err := NewLocaltracing("./log")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := handler.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("测试")
+	}))
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/panic", nil)
+	r.ServeHTTP(w, req)
+	if w.Code != 500 {
+		t.Errorf("异常时状态码错误: %d", w.Code)
+	}
+
+	r = handler.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		CurrentTrace().SetRoute("/fail")
+		w.WriteHeader(503)
+	}))
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/fail", nil)
+	r.ServeHTTP(w, req)
+	for _, item := range handler.LatencySnapshot().Routes {
+		if item.Route == "/fail" && item.Windows["1m"].Errors != 1 {
+			t.Error("5xx响应没有记录为错误")
+		}
+	}
+}
+
+func TestMiddlewareRouteFallback(t *testing.T) {
+	routes := func(opts ...Option) map[string]bool {
+		handler, err := NewLocaltracing("./log", opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/user/", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("hello"))
+		})
+		r := handler.Middleware(mux)
+		for _, url := range []string{"/user/1", "/user/2", "/user/3", "/user/4", "/missing"} {
+			req, _ := http.NewRequest("GET", url, nil)
+			r.ServeHTTP(httptest.NewRecorder(), req)
+		}
+		res := map[string]bool{}
+		for _, item := range handler.LatencySnapshot().Routes {
+			res[item.Route] = true
+		}
+		return res
+	}
+
+	// 不同的id只有一个统计
+	res := routes()
+	if len(res) != 2 || !res["unrouted"] || !res["unmatched"] {
+		t.Errorf("没有设置路由时的统计错误: %v", res)
+	}
+
+	res = routes(WithRouteResolver(func(r *http.Request) string {
+		if strings.HasPrefix(r.URL.Path, "/user/") {
+			return "/user/:id"
+		}
+		return ""
+	}))
+	if len(res) != 2 || !res["/user/:id"] || !res["unmatched"] {
+		t.Errorf("WithRouteResolver的统计错误: %v", res)
+	}
 }
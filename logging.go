@@ -0,0 +1,124 @@
+package localtracing
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+////////////////////
+// 日志输出 stdout与文件分别输出
+// stdout使用带颜色的级别，文件中不包含颜色控制字符，文件按大小切分
+// 请求中记录的日志自动带上trace_id、span_id
+////////////////////
+
+const (
+	LogConsole = "console"
+	LogJSON    = "json"
+)
+
+type logOptions struct {
+	level      zapcore.Level
+	encoding   string
+	stdout     bool
+	file       string // 相对LogDir的文件名 为空时不写入文件
+	maxSize    int    // 单个文件的最大MB 默认100
+	maxAge     int    // 保留的天数 0为不按时间删除
+	maxBackups int    // 保留的旧文件数 0为全部保留
+}
+
+func defaultLogOptions() logOptions {
+	return logOptions{
+		level:    zapcore.DebugLevel,
+		encoding: LogConsole,
+		stdout:   true,
+		file:     baseLog,
+		maxSize:  100,
+	}
+}
+
+func newEncoder(encoding string, color bool) (zapcore.Encoder, error) {
+	cfg := zap.NewProductionEncoderConfig()
+	cfg.EncodeTime = zapcore.ISO8601TimeEncoder
+	cfg.EncodeDuration = zapcore.StringDurationEncoder
+	switch encoding {
+	case LogJSON:
+		return zapcore.NewJSONEncoder(cfg), nil
+	case LogConsole:
+		cfg.EncodeLevel = zapcore.CapitalLevelEncoder
+		if color {
+			cfg.EncodeLevel = zapcore.CapitalColorLevelEncoder
+		}
+		return zapcore.NewConsoleEncoder(cfg), nil
+	}
+	return nil, fmt.Errorf("不支持的日志格式: %s", encoding)
+}
+
+// 根据配置创建logger stdout与文件都关闭时不输出日志
+func newLogger(logDir string, o logOptions) (*zap.Logger, error) {
+	cores := []zapcore.Core{}
+	if o.stdout {
+		enc, err := newEncoder(o.encoding, true)
+		if err != nil {
+			return nil, err
+		}
+		cores = append(cores, zapcore.NewCore(enc, zapcore.Lock(os.Stdout), o.level))
+	}
+	if o.file != "" {
+		enc, err := newEncoder(o.encoding, false)
+		if err != nil {
+			return nil, err
+		}
+		file := &lumberjack.Logger{
+			Filename:   filepath.Join(logDir, o.file),
+			MaxSize:    o.maxSize,
+			MaxAge:     o.maxAge,
+			MaxBackups: o.maxBackups,
+			LocalTime:  true,
+		}
+		cores = append(cores, zapcore.NewCore(enc, zapcore.AddSync(file), o.level))
+	}
+	return zap.New(
+		zapcore.NewTee(cores...),
+		zap.AddCaller(),
+		zap.AddStacktrace(zapcore.ErrorLevel),
+	), nil
+}
+
+// 请求协程中的日志自动带上trace_id、span_id(当前Time()节点)
+// 已经通过With、WithContext或者字段设置了trace_id时不重复添加
+type traceCore struct {
+	zapcore.Core
+
+	traced bool // With中已经带有trace_id
+}
+
+func (c *traceCore) With(fields []zapcore.Field) zapcore.Core {
+	return &traceCore{
+		Core:   c.Core.With(fields),
+		traced: c.traced || traceIDField(fields, "") != "",
+	}
+}
+
+func (c *traceCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *traceCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	if !c.traced && traceIDField(fields, "") == "" {
+		if trace := activeTrace(); trace != nil {
+			fields = append(fields[:len(fields):len(fields)],
+				zap.String("trace_id", trace.TraceID().String()),
+				zap.String("span_id", trace.currentSpan().ID.String()),
+			)
+		}
+	}
+	return c.Core.Write(ent, fields)
+}
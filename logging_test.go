@@ -0,0 +1,138 @@
+package localtracing
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestLogOptions(t *testing.T) {
+	dir := t.TempDir()
+	handler, err := NewLocaltracing(dir,
+		WithLogLevel(zapcore.WarnLevel),
+		WithLogEncoding(LogJSON),
+		WithStdout(false),
+		WithLogFile("app.log"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.Info("ignored")
+	handler.Warn("slow request", zap.Int("ms", 120))
+	handler.Sync()
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "app.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("日志级别错误: %s", data)
+	}
+	entry := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["msg"] != "slow request" || entry["level"] != "warn" || entry["ms"] != float64(120) {
+		t.Errorf("json格式错误: %s", lines[0])
+	}
+}
+
+// 默认的console格式 文件中不包含颜色控制字符
+func TestLogFileNoColor(t *testing.T) {
+	dir := t.TempDir()
+	handler, err := NewLocaltracing(dir, WithStdout(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.Error("boom")
+	handler.Sync()
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, baseLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "ERROR\t") || strings.Contains(string(data), "\x1b[") {
+		t.Errorf("文件格式错误: %q", data)
+	}
+
+	if _, err := NewLocaltracing(dir, WithLogEncoding("xml")); err == nil {
+		t.Error("不支持的格式应该返回错误")
+	}
+}
+
+func TestLogRotation(t *testing.T) {
+	dir := t.TempDir()
+	handler, err := NewLocaltracing(dir, WithStdout(false), WithLogRotation(1, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := strings.Repeat("x", 1024)
+	for i := 0; i < 1500; i++ {
+		handler.Info(line)
+	}
+	handler.Sync()
+
+	files, err := filepath.Glob(filepath.Join(dir, "base-*.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Error("超过大小时没有切分文件")
+	}
+}
+
+// 请求中handler自己的日志带有请求的trace_id 协程外的日志不带
+func TestLogTraceID(t *testing.T) {
+	dir := t.TempDir()
+	handler, err := NewLocaltracing(dir, WithLogEncoding(LogJSON), WithStdout(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := handler.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.Info("handler line")
+		func() {
+			defer handler.Time()()
+			handler.Info("nested line")
+		}()
+		handler.WithContext(context.Background()).Info("context line")
+	}))
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/log", nil)
+	r.ServeHTTP(rw, req)
+	handler.Info("outside")
+	handler.Sync()
+
+	traceID, _, _, _ := ParseTraceparent(rw.Header().Get(TraceresponseHeader))
+	data, err := ioutil.ReadFile(filepath.Join(dir, baseLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := map[string]map[string]interface{}{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		entry := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		entries[entry["msg"].(string)] = entry
+	}
+	for _, msg := range []string{"handler line", "nested line", "context line", "request:"} {
+		if entries[msg]["trace_id"] != traceID.String() {
+			t.Errorf("%s没有带上trace_id: %v", msg, entries[msg])
+		}
+	}
+	if entries["handler line"]["span_id"] == entries["nested line"]["span_id"] {
+		t.Error("Time()中的日志应该使用当前节点的span_id")
+	}
+	if _, ok := entries["outside"]["trace_id"]; ok {
+		t.Error("请求之外的日志不应该带有trace_id")
+	}
+}
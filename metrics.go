@@ -0,0 +1,278 @@
+package localtracing
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+////////////////////
+// Prometheus指标 使用文本格式(0.0.4)输出
+// 与耗时统计不同 这里的计数器以及直方图从启动开始累加 由Prometheus计算速率
+////////////////////
+
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// 耗时直方图的桶 单位为秒 与Prometheus客户端的默认值相同
+var metricsBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type promHistogram struct {
+	counts []uint64 // 与metricsBuckets对应 最后一个为+Inf
+	sum    float64
+	count  uint64
+}
+
+func newPromHistogram() *promHistogram {
+	return &promHistogram{counts: make([]uint64, len(metricsBuckets)+1)}
+}
+
+func (h *promHistogram) Observe(d time.Duration) {
+	v := d.Seconds()
+	idx := sort.SearchFloat64s(metricsBuckets, v)
+	h.counts[idx]++
+	h.sum += v
+	h.count++
+}
+
+type requestKey struct {
+	method string
+	route  string
+	status int
+}
+
+type metrics struct {
+	// 原子操作的字段放在前面 保证32位平台上的对齐
+	inFlight     int64
+	wsClients    int64
+	tailSubs     int64
+	droppedLines uint64
+
+	mu       sync.Mutex
+	requests map[requestKey]*promHistogram
+	spans    map[string]*promHistogram
+	panics   map[routeKey]uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests: map[requestKey]*promHistogram{},
+		spans:    map[string]*promHistogram{},
+		panics:   map[routeKey]uint64{},
+	}
+}
+
+// 请求开始 返回的函数在请求结束时调用
+func (m *metrics) StartRequest() func() {
+	if m == nil {
+		return func() {}
+	}
+	atomic.AddInt64(&m.inFlight, 1)
+	return func() { atomic.AddInt64(&m.inFlight, -1) }
+}
+
+func (m *metrics) ObserveRequest(method, route string, status int, d time.Duration, panicked bool) {
+	if m == nil {
+		return
+	}
+	key := requestKey{method: method, route: route, status: status}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.requests[key]
+	if !ok {
+		h = newPromHistogram()
+		m.requests[key] = h
+	}
+	h.Observe(d)
+	if panicked {
+		m.panics[routeKey{method: method, route: route}]++
+	}
+}
+
+func (m *metrics) ObserveSpan(name string, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.spans[name]
+	if !ok {
+		h = newPromHistogram()
+		m.spans[name] = h
+	}
+	h.Observe(d)
+}
+
+// 记录一个连接 ctx结束时减少
+func track(val *int64, ctx context.Context) {
+	atomic.AddInt64(val, 1)
+	go func() {
+		<-ctx.Done()
+		atomic.AddInt64(val, -1)
+	}()
+}
+
+// websocket连接
+func (m *metrics) TrackWebsocket(ctx context.Context) {
+	if m == nil {
+		return
+	}
+	track(&m.wsClients, ctx)
+}
+
+// 日志tail的订阅
+func (m *metrics) TrackTail(ctx context.Context) {
+	if m == nil {
+		return
+	}
+	track(&m.tailSubs, ctx)
+}
+
+// 订阅者来不及读取而丢弃的日志行
+func (m *metrics) DropLine() {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.droppedLines, 1)
+}
+
+type metricLabel struct {
+	name string
+	val  string
+}
+
+type metricsWriter struct {
+	w *bufio.Writer
+}
+
+func (w *metricsWriter) header(name, typ, help string) {
+	fmt.Fprintf(w.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (w *metricsWriter) sample(name string, labels []metricLabel, val float64) {
+	w.w.WriteString(name)
+	if len(labels) > 0 {
+		w.w.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				w.w.WriteByte(',')
+			}
+			fmt.Fprintf(w.w, "%s=\"%s\"", label.name, escapeLabel(label.val))
+		}
+		w.w.WriteByte('}')
+	}
+	w.w.WriteByte(' ')
+	w.w.WriteString(formatFloat(val))
+	w.w.WriteByte('\n')
+}
+
+func (w *metricsWriter) histogram(name string, labels []metricLabel, h *promHistogram) {
+	var cum uint64
+	for i, count := range h.counts {
+		cum += count
+		le := "+Inf"
+		if i < len(metricsBuckets) {
+			le = formatFloat(metricsBuckets[i])
+		}
+		w.sample(name+"_bucket", append(labels[:len(labels):len(labels)], metricLabel{"le", le}), float64(cum))
+	}
+	w.sample(name+"_sum", labels, h.sum)
+	w.sample(name+"_count", labels, float64(h.count))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(val string) string {
+	return labelEscaper.Replace(val)
+}
+
+func formatFloat(val float64) string {
+	switch {
+	case math.IsInf(val, 1):
+		return "+Inf"
+	case math.IsInf(val, -1):
+		return "-Inf"
+	case math.IsNaN(val):
+		return "NaN"
+	}
+	return strconv.FormatFloat(val, 'g', -1, 64)
+}
+
+// 写入所有指标 按照标签排序 保证输出稳定
+func (m *metrics) Expose(out io.Writer) error {
+	m.mu.Lock()
+	requests := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		requests = append(requests, key)
+	}
+	spans := make([]string, 0, len(m.spans))
+	for name := range m.spans {
+		spans = append(spans, name)
+	}
+	panics := make([]routeKey, 0, len(m.panics))
+	for key := range m.panics {
+		panics = append(panics, key)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		a, b := requests[i], requests[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.status < b.status
+	})
+	sort.Strings(spans)
+	sort.Slice(panics, func(i, j int) bool {
+		if panics[i].route != panics[j].route {
+			return panics[i].route < panics[j].route
+		}
+		return panics[i].method < panics[j].method
+	})
+
+	w := &metricsWriter{w: bufio.NewWriter(out)}
+	w.header("localtracing_http_requests_total", "counter", "Total number of HTTP requests.")
+	for _, key := range requests {
+		w.sample("localtracing_http_requests_total", requestLabels(key), float64(m.requests[key].count))
+	}
+	w.header("localtracing_http_request_duration_seconds", "histogram", "HTTP request duration in seconds.")
+	for _, key := range requests {
+		w.histogram("localtracing_http_request_duration_seconds", requestLabels(key), m.requests[key])
+	}
+	w.header("localtracing_http_panics_total", "counter", "Total number of HTTP requests that panicked.")
+	for _, key := range panics {
+		w.sample("localtracing_http_panics_total", []metricLabel{{"method", key.method}, {"route", key.route}}, float64(m.panics[key]))
+	}
+	w.header("localtracing_span_duration_seconds", "histogram", "Duration of functions recorded by Time() in seconds.")
+	for _, name := range spans {
+		w.histogram("localtracing_span_duration_seconds", []metricLabel{{"function", name}}, m.spans[name])
+	}
+	m.mu.Unlock()
+
+	w.header("localtracing_http_requests_in_flight", "gauge", "Number of HTTP requests currently being served.")
+	w.sample("localtracing_http_requests_in_flight", nil, float64(atomic.LoadInt64(&m.inFlight)))
+	w.header("localtracing_websocket_clients", "gauge", "Number of connected websocket clients.")
+	w.sample("localtracing_websocket_clients", nil, float64(atomic.LoadInt64(&m.wsClients)))
+	w.header("localtracing_tail_subscribers", "gauge", "Number of log tail subscribers.")
+	w.sample("localtracing_tail_subscribers", nil, float64(atomic.LoadInt64(&m.tailSubs)))
+	w.header("localtracing_tail_dropped_lines_total", "counter", "Total number of log lines dropped for slow tail subscribers.")
+	w.sample("localtracing_tail_dropped_lines_total", nil, float64(atomic.LoadUint64(&m.droppedLines)))
+	return w.w.Flush()
+}
+
+func requestLabels(key requestKey) []metricLabel {
+	return []metricLabel{
+		{"method", key.method},
+		{"route", key.route},
+		{"status", strconv.Itoa(key.status)},
+	}
+}
@@ -0,0 +1,90 @@
+package localtracing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMonitorMetrics(t *testing.T) {
+	mux := newTestHandler()
+	handler, err := NewMonitor(mux, "./log")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var inFlight string
+	app := handler.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer handler.Time()()
+		CurrentTrace().SetRoute("/user/:id")
+		if r.URL.Path == "/user/panic" {
+			panic("boom")
+		}
+		if r.URL.Path == "/user/metrics" {
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+			inFlight = rec.Body.String()
+		}
+		w.WriteHeader(201)
+	}))
+	for _, url := range []string{"/user/1", "/user/2", "/user/panic", "/user/metrics"} {
+		app.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", url, nil))
+	}
+	if !strings.Contains(inFlight, "\nlocaltracing_http_requests_in_flight 1\n") {
+		t.Errorf("处理中的请求数错误: %s", inFlight)
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != 200 || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("响应错误: %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	body := w.Body.String()
+	for _, line := range []string{
+		"# TYPE localtracing_http_requests_total counter",
+		`localtracing_http_requests_total{method="GET",route="/user/:id",status="201"} 3`,
+		`localtracing_http_requests_total{method="GET",route="/user/:id",status="500"} 1`,
+		"# TYPE localtracing_http_request_duration_seconds histogram",
+		`localtracing_http_request_duration_seconds_bucket{method="GET",route="/user/:id",status="201",le="+Inf"} 3`,
+		`localtracing_http_request_duration_seconds_count{method="GET",route="/user/:id",status="500"} 1`,
+		`localtracing_http_panics_total{method="GET",route="/user/:id"} 1`,
+		`localtracing_span_duration_seconds_count{function="github.com/wwqdrh/localtracing.TestMonitorMetrics.func1"} 4`,
+		"localtracing_http_requests_in_flight 0",
+		"localtracing_websocket_clients 0",
+		"localtracing_tail_subscribers 0",
+		"localtracing_tail_dropped_lines_total 0",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("缺少指标: %s", line)
+		}
+	}
+	if t.Failed() {
+		t.Log(body)
+	}
+}
+
+func TestMetricsHistogram(t *testing.T) {
+	m := newMetrics()
+	m.ObserveSpan(`a"b\c`, 3*time.Millisecond)
+	m.ObserveSpan(`a"b\c`, 200*time.Millisecond)
+	m.ObserveSpan(`a"b\c`, time.Minute)
+
+	var buf strings.Builder
+	if err := m.Expose(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`localtracing_span_duration_seconds_bucket{function="a\"b\\c",le="0.005"} 1`,
+		`localtracing_span_duration_seconds_bucket{function="a\"b\\c",le="0.25"} 2`,
+		`localtracing_span_duration_seconds_bucket{function="a\"b\\c",le="10"} 2`,
+		`localtracing_span_duration_seconds_bucket{function="a\"b\\c",le="+Inf"} 3`,
+		`localtracing_span_duration_seconds_sum{function="a\"b\\c"} 60.203`,
+		`localtracing_span_duration_seconds_count{function="a\"b\\c"} 3`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("缺少指标: %s\n%s", line, buf.String())
+		}
+	}
+}
@@ -1,18 +1,25 @@
 package localtracing
 
 import (
+	"bytes"
 	"context"
-	"html/template"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
+	"strconv"
+	"strings"
+	"time"
 
 	"net/http/pprof"
 
 	"github.com/hpcloud/tail"
 
-	assetfs "github.com/elazarl/go-bindata-assetfs"
 	"github.com/gorilla/websocket"
 )
 
@@ -40,18 +47,6 @@ var upgrader = websocket.Upgrader{
 	},
 } // use default options
 
-var (
-	// 静态资源
-	fs = &assetfs.AssetFS{
-		Asset: func(name string) ([]byte, error) {
-			return Asset(name)
-		},
-		AssetDir: func(name string) ([]string, error) {
-			return AssetDir(name)
-		},
-	}
-)
-
 type (
 	HTTPHandler interface {
 		Context(val interface{}) (*http.Request, http.ResponseWriter, error) // 获取request与response
@@ -59,32 +54,47 @@ type (
 		Post(string, func(interface{}))
 		Static(string, http.FileSystem) // 挂载静态资源目录
 	}
-
-	// bindata-template包装
-	AssetFunc func(string) ([]byte, error)
-
-	bindataTemplate struct {
-		*template.Template
-
-		AssetFunc AssetFunc
-	}
 )
 type MonitorServer struct {
 	httpHandler HTTPHandler
+	tracing     *LocalTracing
+	views       fs.FS        // 页面以及静态资源 只包含views目录
+	watcher     *viewWatcher // 开发模式下监听页面的修改
 }
 
 // 挂载路由
-func NewMonitor(fn HTTPHandler, logDir string) (*LocalTracing, error) {
-	handler, err := NewLocaltracing(logDir)
+func NewMonitor(fn HTTPHandler, logDir string, opts ...Option) (*LocalTracing, error) {
+	handler, err := NewLocaltracing(logDir, opts...)
 	if err != nil {
 		return nil, err
 	}
 
-	s := MonitorServer{httpHandler: fn}
+	// 只挂载views目录 开发模式下不能暴露项目中的其他文件
+	root := Views
+	if dir := newOptions(opts).viewsDir; dir != "" {
+		root = os.DirFS(dir)
+	}
+	s := MonitorServer{httpHandler: fn, tracing: handler}
+	if s.views, err = fs.Sub(root, "views"); err != nil {
+		return nil, err
+	}
+	if dir := newOptions(opts).viewsDir; dir != "" {
+		s.watcher = newViewWatcher(path.Join(dir, "views"), viewWatchInterval)
+		// 页面文件修改后通知浏览器刷新
+		fn.Get("/view/reload", s.reloadData)
+	}
 	// 静态资源
-	fn.Static("/static", fs)
+	fn.Static("/static/views", http.FS(s.views))
 	// 实时日志页面
 	fn.Get("/view", s.indexView)
+	// 调用链路耗时分析页面
+	fn.Get("/view/trace", s.traceView)
+	// 路由耗时趋势页面
+	fn.Get("/view/latency", s.latencyView)
+	// panic报告页面
+	fn.Get("/view/panic", s.panicView)
+	// 错误分组页面
+	fn.Get("/view/errors", s.errorsView)
 	// 健康检查
 	fn.Get("/heath", s.health)
 	// 获取当前所有的日志列表
@@ -93,28 +103,42 @@ func NewMonitor(fn HTTPHandler, logDir string) (*LocalTracing, error) {
 	// 根据日志文件获取内容 需要使用websocket持续连接
 	fn.Get("/log/data", s.LogData)
 
+	// Prometheus指标
+	fn.Get("/metrics", s.Metrics)
+	// 路由以及函数的耗时分布
+	fn.Get("/metrics/latency", s.Latency)
+	// 路由最近一小时的趋势 需要使用websocket持续获取
+	fn.Get("/metrics/latency/timeline", s.LatencyTimeline)
+	fn.Get("/metrics/latency/data", s.LatencyData)
+
+	// 最近请求的列表 ?route=&method=&status=500|5xx|error&min_duration=100ms&from=&to=&limit=
+	fn.Get("/trace/list", s.TraceList)
+	// 请求的完整调用树
+	fn.Get("/trace/:id", s.TraceDetail)
+	// 导出最近请求的调用树 ?format=zipkin|jaeger|chrome&id=trace id
+	fn.Get("/trace/export", s.ExportTraces)
+	// 请求的时间线 chrome://tracing、Perfetto格式
+	fn.Get("/trace/:id/chrome", s.ChromeTrace)
+
+	// 最近的panic报告
+	fn.Get("/panic/list", s.PanicList)
+	// panic报告的详情 包括完整的调用栈以及调用树
+	fn.Get("/panic/:id", s.PanicDetail)
+	// 按照指纹聚合的panic以及Error日志 ?kind=panic|log
+	fn.Get("/errors", s.ErrorList)
+	// 错误分组的调用栈以及最近的请求
+	fn.Get("/errors/:fingerprint", s.ErrorDetail)
+
 	// 开启pprof
 	s.EnableProf()
 
 	return handler, nil
 }
 
-// bindatatemplate 方法
-func ExecuteBinTemplate(wr io.Writer, name, path string, data interface{}) error {
-	tmpl := &bindataTemplate{
-		Template:  template.New(name),
-		AssetFunc: Asset,
-	}
-
-	tmplBytes, err := tmpl.AssetFunc(path)
-	if err != nil {
-		return err
-	}
-	newTmpl, err := tmpl.Parse(string(tmplBytes))
-	if err != nil {
-		return err
-	}
-	return newTmpl.Execute(wr, data)
+// 渲染页面 开发模式下页面中加入自动刷新的脚本
+func (s *MonitorServer) executeTemplate(wr io.Writer, name, path string, data map[string]interface{}) error {
+	data["LiveReload"] = s.watcher != nil
+	return ExecuteTemplateFS(s.views, wr, name, path, data)
 }
 
 // 路由函数
@@ -126,10 +150,10 @@ func (s *MonitorServer) indexView(ctx interface{}) {
 	} else {
 		// htmlTplEngine.ExecuteTemplate()
 		logfile := r.URL.Query().Get("file")
-		if err := ExecuteBinTemplate(
+		if err := s.executeTemplate(
 			w,
 			"index",
-			"views/index.html",
+			"index.html",
 			map[string]interface{}{"PageTitle": "实时日志", "LogFile": logfile},
 		); err != nil {
 			w.WriteHeader(500)
@@ -138,6 +162,98 @@ func (s *MonitorServer) indexView(ctx interface{}) {
 	}
 }
 
+// 最近请求列表以及调用链路的瀑布图 ?id=trace id打开指定的请求
+func (s *MonitorServer) traceView(ctx interface{}) {
+	r, w, err := s.httpHandler.Context(ctx)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err := s.executeTemplate(
+		w,
+		"trace",
+		"trace.html",
+		map[string]interface{}{"PageTitle": "调用链路", "TraceID": r.URL.Query().Get("id")},
+	); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+	}
+}
+
+// 路由的请求数、错误率以及p50/p99趋势图
+func (s *MonitorServer) latencyView(ctx interface{}) {
+	_, w, err := s.httpHandler.Context(ctx)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err := s.executeTemplate(
+		w,
+		"latency",
+		"latency.html",
+		map[string]interface{}{"PageTitle": "路由耗时"},
+	); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+	}
+}
+
+// panic报告列表以及详情 ?id=报告id打开指定的报告
+func (s *MonitorServer) panicView(ctx interface{}) {
+	r, w, err := s.httpHandler.Context(ctx)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err := s.executeTemplate(
+		w,
+		"panic",
+		"panic.html",
+		map[string]interface{}{"PageTitle": "panic报告", "PanicID": r.URL.Query().Get("id")},
+	); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+	}
+}
+
+// 错误分组列表以及详情 ?fingerprint=打开指定的分组
+func (s *MonitorServer) errorsView(ctx interface{}) {
+	r, w, err := s.httpHandler.Context(ctx)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err := s.executeTemplate(
+		w,
+		"errors",
+		"errors.html",
+		map[string]interface{}{"PageTitle": "错误分组", "Fingerprint": r.URL.Query().Get("fingerprint")},
+	); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+	}
+}
+
+// ws: 开发模式下页面文件修改时通知刷新
+func (s *MonitorServer) reloadData(ctx interface{}) {
+	r, w, _ := s.httpHandler.Context(ctx)
+
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte("upgrade error: " + err.Error()))
+		return
+	}
+	conte, cancel := context.WithCancel(context.TODO())
+	s.tracing.metrics.TrackWebsocket(conte)
+	go WsRead(ws, conte, cancel)
+	go WsWrite(ws, s.watcher.Subscribe(conte), conte, cancel)
+}
+
 // 健康检查
 func (s *MonitorServer) health(ctx interface{}) {
 	_, w, err := s.httpHandler.Context(ctx)
@@ -167,7 +283,7 @@ func (s *MonitorServer) LogData(ctx interface{}) {
 	r, w, _ := s.httpHandler.Context(ctx)
 
 	// check log is exist?
-	file := path.Join(Tracing.LogDir, r.URL.Query().Get("file"))
+	file := path.Join(s.tracing.LogDir, r.URL.Query().Get("file"))
 	_, err := os.Stat(file)
 	if os.IsNotExist(err) {
 		w.WriteHeader(500)
@@ -184,8 +300,283 @@ func (s *MonitorServer) LogData(ctx interface{}) {
 	}
 	// ctx
 	conte, cancel := context.WithCancel(context.TODO())
+	s.tracing.metrics.TrackWebsocket(conte)
 	go WsRead(ws, conte, cancel)
-	go WsWrite(ws, Tracing.TailLog(file, conte), conte, cancel)
+	go WsWrite(ws, s.tracing.TailLog(file, conte), conte, cancel)
+}
+
+// Prometheus指标
+func (s *MonitorServer) Metrics(ctx interface{}) {
+	_, w, err := s.httpHandler.Context(ctx)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	var buf bytes.Buffer
+	if err := s.tracing.WriteMetrics(&buf); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", metricsContentType)
+	w.WriteHeader(200)
+	w.Write(buf.Bytes())
+}
+
+// 耗时分布 p50/p90/p99/p999以及错误率
+func (s *MonitorServer) Latency(ctx interface{}) {
+	_, w, err := s.httpHandler.Context(ctx)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	writeJSON(w, s.tracing.LatencySnapshot())
+}
+
+// 最近请求的列表 新的在前
+func (s *MonitorServer) TraceList(ctx interface{}) {
+	r, w, err := s.httpHandler.Context(ctx)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	filter, err := parseTraceFilter(r.URL.Query())
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	recs := s.tracing.FindTraces(filter)
+	traces := make([]TraceSummary, 0, len(recs))
+	for _, rec := range recs {
+		traces = append(traces, rec.Summary())
+	}
+	writeJSON(w, map[string]interface{}{
+		"traces": traces,
+		"stats":  s.tracing.TraceStoreStats(),
+	})
+}
+
+// 请求的完整调用树 同一个trace多次经过本服务时返回多个请求
+func (s *MonitorServer) TraceDetail(ctx interface{}) {
+	r, w, err := s.httpHandler.Context(ctx)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	id, err := traceIDParam(r.URL.Path)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	recs := s.tracing.LookupTrace(id)
+	if len(recs) == 0 {
+		w.WriteHeader(404)
+		w.Write([]byte(ErrTraceNotFound.Error()))
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"trace_id": id,
+		"requests": recs,
+	})
+}
+
+// 最近的panic报告 新的在前
+func (s *MonitorServer) PanicList(ctx interface{}) {
+	_, w, err := s.httpHandler.Context(ctx)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	reports, err := s.tracing.PanicReports()
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	writeJSON(w, map[string]interface{}{"panics": reports})
+}
+
+// 完整的panic报告
+func (s *MonitorServer) PanicDetail(ctx interface{}) {
+	r, w, err := s.httpHandler.Context(ctx)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	report, err := s.tracing.PanicReport(path.Base(r.URL.Path))
+	if errors.Is(err, ErrPanicNotFound) {
+		w.WriteHeader(404)
+		w.Write([]byte(err.Error()))
+		return
+	} else if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	writeJSON(w, report)
+}
+
+// 错误分组 最近出现的在前
+func (s *MonitorServer) ErrorList(ctx interface{}) {
+	r, w, err := s.httpHandler.Context(ctx)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	groups := s.tracing.ErrorGroups()
+	if kind := r.URL.Query().Get("kind"); kind != "" {
+		res := make([]*ErrorGroup, 0, len(groups))
+		for _, group := range groups {
+			if group.Kind == kind {
+				res = append(res, group)
+			}
+		}
+		groups = res
+	}
+	writeJSON(w, map[string]interface{}{"errors": groups})
+}
+
+// 错误分组的详情
+func (s *MonitorServer) ErrorDetail(ctx interface{}) {
+	r, w, err := s.httpHandler.Context(ctx)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	group, err := s.tracing.LookupErrorGroup(path.Base(r.URL.Path))
+	if err != nil {
+		w.WriteHeader(404)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	writeJSON(w, group)
+}
+
+// 以Zipkin或者Jaeger格式下载调用树 没有指定id时导出所有最近的请求
+func (s *MonitorServer) ExportTraces(ctx interface{}) {
+	r, w, err := s.httpHandler.Context(ctx)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	query := r.URL.Query()
+	format, err := ParseExportFormat(query.Get("format"))
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	recs := s.tracing.RecentTraces()
+	name := "traces"
+	if val := query.Get("id"); val != "" {
+		id, err := ParseTraceID(val)
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if recs = s.tracing.LookupTrace(id); len(recs) == 0 {
+			w.WriteHeader(404)
+			w.Write([]byte(ErrTraceNotFound.Error()))
+			return
+		}
+		name = val
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"."+string(format)+".json"))
+	w.WriteHeader(200)
+	WriteTraces(w, format, s.tracing.service, recs)
+}
+
+// 请求的Chrome Trace Event JSON
+func (s *MonitorServer) ChromeTrace(ctx interface{}) {
+	r, w, err := s.httpHandler.Context(ctx)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	id, err := traceIDParam(r.URL.Path)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	if err := s.tracing.ChromeTrace(buf, id); err != nil {
+		w.WriteHeader(404)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", id.String()+".chrome.json"))
+	w.WriteHeader(200)
+	w.Write(buf.Bytes())
+}
+
+// 路由最近一小时每分钟的统计
+func (s *MonitorServer) LatencyTimeline(ctx interface{}) {
+	_, w, err := s.httpHandler.Context(ctx)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	writeJSON(w, s.tracing.LatencyTimeline())
+}
+
+// ws: 定时推送路由的趋势数据
+func (s *MonitorServer) LatencyData(ctx interface{}) {
+	r, w, _ := s.httpHandler.Context(ctx)
+
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte("upgrade error: " + err.Error()))
+		return
+	}
+	conte, cancel := context.WithCancel(context.TODO())
+	s.tracing.metrics.TrackWebsocket(conte)
+	go WsRead(ws, conte, cancel)
+	go WsWrite(ws, s.latencyFeed(conte), conte, cancel)
+}
+
+// 连接建立时立即推送一次 之后每个统计时间片推送一次
+func (s *MonitorServer) latencyFeed(ctx context.Context) chan string {
+	ch := make(chan string, 1)
+	go func() {
+		ticker := time.NewTicker(slotDuration)
+		defer ticker.Stop()
+		for {
+			if body, err := json.Marshal(s.tracing.LatencyTimeline()); err == nil {
+				select {
+				case ch <- string(body):
+				default: // 上一次的数据还没有发送
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return ch
 }
 
 func (s *MonitorServer) EnableProf() {
@@ -204,3 +595,93 @@ func (s *MonitorServer) EnableProf() {
 	s.httpHandler.Get(prefix+"/mutex", WrapH(s.httpHandler, pprof.Handler("mutex")))
 	s.httpHandler.Get(prefix+"/threadcreate", WrapH(s.httpHandler, pprof.Handler("threadcreate")))
 }
+
+// 从路径中读取trace id 例如/trace/:id、/trace/:id/chrome 路由可能挂载在其他前缀下
+func traceIDParam(p string) (TraceID, error) {
+	parts := strings.Split(strings.Trim(p, "/"), "/")
+	for i := len(parts) - 2; i >= 0; i-- {
+		if parts[i] == "trace" {
+			return ParseTraceID(parts[i+1])
+		}
+	}
+	return TraceID{}, errors.New("trace id格式错误")
+}
+
+// 列表的查询条件 默认返回最近100个请求
+func parseTraceFilter(query url.Values) (TraceFilter, error) {
+	f := TraceFilter{
+		Route:  query.Get("route"),
+		Method: query.Get("method"),
+		Limit:  100,
+	}
+
+	switch status := strings.ToLower(query.Get("status")); {
+	case status == "":
+	case status == "error":
+		f.Failed = true
+	case len(status) == 3 && strings.HasSuffix(status, "xx"):
+		class, err := strconv.Atoi(status[:1])
+		if err != nil {
+			return f, errors.New("status格式错误")
+		}
+		f.StatusClass = class
+	default:
+		code, err := strconv.Atoi(status)
+		if err != nil {
+			return f, errors.New("status格式错误")
+		}
+		f.Status = code
+	}
+
+	if val := query.Get("min_duration"); val != "" {
+		d, err := parseDuration(val)
+		if err != nil {
+			return f, errors.New("min_duration格式错误")
+		}
+		f.MinDuration = d
+	}
+	var err error
+	if f.From, err = parseTime(query.Get("from")); err != nil {
+		return f, errors.New("from格式错误")
+	}
+	if f.To, err = parseTime(query.Get("to")); err != nil {
+		return f, errors.New("to格式错误")
+	}
+	if val := query.Get("limit"); val != "" {
+		if f.Limit, err = strconv.Atoi(val); err != nil {
+			return f, errors.New("limit格式错误")
+		}
+	}
+	return f, nil
+}
+
+// 支持time.ParseDuration的格式 纯数字为毫秒
+func parseDuration(val string) (time.Duration, error) {
+	if ms, err := strconv.ParseFloat(val, 64); err == nil {
+		return time.Duration(ms * float64(time.Millisecond)), nil
+	}
+	return time.ParseDuration(val)
+}
+
+// 支持RFC3339 纯数字为unix毫秒
+func parseTime(val string) (time.Time, error) {
+	if val == "" {
+		return time.Time{}, nil
+	}
+	if ms, err := strconv.ParseInt(val, 10, 64); err == nil {
+		return time.Unix(0, ms*int64(time.Millisecond)), nil
+	}
+	return time.Parse(time.RFC3339, val)
+}
+
+func writeJSON(w http.ResponseWriter, data interface{}) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(200)
+	w.Write(body)
+}
@@ -0,0 +1,283 @@
+package localtracing
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 基于net/http的HTTPHandler 路由支持:param
+type testHandler struct {
+	routes map[string]map[string]func(interface{}) // method -> path -> handler
+	static map[string]http.FileSystem              // prefix -> 静态资源
+}
+
+type testContext struct {
+	w http.ResponseWriter
+	r *http.Request
+}
+
+func newTestHandler() *testHandler {
+	return &testHandler{
+		routes: map[string]map[string]func(interface{}){"GET": {}, "POST": {}},
+		static: map[string]http.FileSystem{},
+	}
+}
+
+func (h *testHandler) Context(val interface{}) (*http.Request, http.ResponseWriter, error) {
+	c := val.(*testContext)
+	return c.r, c.w, nil
+}
+
+func (h *testHandler) Get(path string, fn func(interface{}))    { h.routes["GET"][path] = fn }
+func (h *testHandler) Post(path string, fn func(interface{}))   { h.routes["POST"][path] = fn }
+func (h *testHandler) Static(prefix string, fs http.FileSystem) { h.static[prefix] = fs }
+
+func (h *testHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for prefix, fs := range h.static {
+		if strings.HasPrefix(r.URL.Path, prefix+"/") {
+			http.StripPrefix(prefix, http.FileServer(fs)).ServeHTTP(w, r)
+			return
+		}
+	}
+	parts := strings.Split(r.URL.Path, "/")
+	for pattern, fn := range h.routes[r.Method] {
+		expect := strings.Split(pattern, "/")
+		if len(expect) != len(parts) {
+			continue
+		}
+		matched := true
+		for i := range expect {
+			if expect[i] != parts[i] && !strings.HasPrefix(expect[i], ":") {
+				matched = false
+				break
+			}
+		}
+		// 静态路由优先
+		if matched && (pattern == r.URL.Path || h.routes[r.Method][r.URL.Path] == nil) {
+			fn(&testContext{w: w, r: r})
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+func TestMonitorExportTraces(t *testing.T) {
+	mux := newTestHandler()
+	handler, err := NewMonitor(mux, "./log", WithServiceName("demo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := handler.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer handler.Time()()
+	}))
+	req := httptest.NewRequest("GET", "/user/1", nil)
+	req.Header.Set(TraceparentHeader, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	app.ServeHTTP(httptest.NewRecorder(), req)
+	app.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/user/2", nil))
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/trace/export?format=zipkin&id=0af7651916cd43dd8448eb211c80319c", nil))
+	spans := []zipkinSpan{}
+	if err := json.Unmarshal(w.Body.Bytes(), &spans); err != nil {
+		t.Fatal(err)
+	}
+	if len(spans) != 2 || spans[0].LocalEndpoint.ServiceName != "demo" || spans[0].ParentID != "b7ad6b7169203331" {
+		t.Errorf("导出错误: %s", w.Body.String())
+	}
+	if !strings.Contains(w.Header().Get("Content-Disposition"), "0af7651916cd43dd8448eb211c80319c.zipkin.json") {
+		t.Error("文件名错误")
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/trace/export?format=jaeger", nil))
+	res := &jaegerResponse{}
+	if err := json.Unmarshal(w.Body.Bytes(), res); err != nil || len(res.Data) != 2 {
+		t.Errorf("导出全部错误: %s", w.Body.String())
+	}
+
+	for url, code := range map[string]int{
+		"/trace/export?format=xml":                          400,
+		"/trace/export?id=xyz":                              400,
+		"/trace/export?id=11111111111111111111111111111111": 404,
+	} {
+		w = httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		if w.Code != code {
+			t.Errorf("%s 状态码错误: %d", url, w.Code)
+		}
+	}
+}
+
+func TestMonitorChromeTrace(t *testing.T) {
+	mux := newTestHandler()
+	handler, err := NewMonitor(mux, "./log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := handler.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer handler.Time()()
+		done := make(chan struct{})
+		Go(func() {
+			defer close(done)
+			defer handler.Time()()
+		})
+		<-done
+	}))
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest("GET", "/user/1", nil))
+	traceID := strings.Split(w.Header().Get(TraceresponseHeader), "-")[1]
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/trace/"+traceID+"/chrome", nil))
+	res := &chromeTraceFile{}
+	if err := json.Unmarshal(w.Body.Bytes(), res); err != nil {
+		t.Fatal(err)
+	}
+	tids := map[int]int{}
+	for _, item := range res.TraceEvents {
+		if item.Ph == "X" {
+			tids[item.Tid]++
+		}
+	}
+	// 请求协程: 根节点与handler 子协程: goroutine与其中的函数
+	if tids[0] != 2 || tids[1] != 2 {
+		t.Errorf("事件错误: %s", w.Body.String())
+	}
+
+	for url, code := range map[string]int{
+		"/trace/xyz/chrome": 400,
+		"/trace/11111111111111111111111111111111/chrome": 404,
+	} {
+		w = httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		if w.Code != code {
+			t.Errorf("%s 状态码错误: %d", url, w.Code)
+		}
+	}
+}
+
+func TestMonitorTraceList(t *testing.T) {
+	mux := newTestHandler()
+	handler, err := NewMonitor(mux, "./log", WithTraceBuffer(10, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := handler.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		CurrentTrace().SetRoute(r.URL.Path)
+		defer handler.Time()()
+		if r.URL.Path == "/slow" {
+			time.Sleep(20 * time.Millisecond)
+			w.WriteHeader(503)
+		}
+	}))
+	app.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/fast", nil))
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest("GET", "/slow", nil))
+	slowID := strings.Split(w.Header().Get(TraceresponseHeader), "-")[1]
+
+	for url, count := range map[string]int{
+		"/trace/list":                   2,
+		"/trace/list?route=/fast":       1,
+		"/trace/list?status=5xx":        1,
+		"/trace/list?status=200":        1,
+		"/trace/list?min_duration=20ms": 1,
+		"/trace/list?limit=1":           1,
+		"/trace/list?from=" + time.Now().Add(time.Minute).Format(time.RFC3339): 0,
+	} {
+		w = httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		res := struct {
+			Traces []TraceSummary  `json:"traces"`
+			Stats  TraceStoreStats `json:"stats"`
+		}{}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Traces) != count || res.Stats.Count != 2 {
+			t.Errorf("%s: 数量错误 %d", url, len(res.Traces))
+		}
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/trace/list?status=abc", nil))
+	if w.Code != 400 {
+		t.Error("参数错误时应该返回400")
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/trace/"+slowID, nil))
+	res := struct {
+		TraceID  string         `json:"trace_id"`
+		Requests []*TraceRecord `json:"requests"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.TraceID != slowID || len(res.Requests) != 1 || res.Requests[0].Status != 503 || len(res.Requests[0].Root.Children) != 1 {
+		t.Errorf("详情错误: %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/trace/11111111111111111111111111111111", nil))
+	if w.Code != 404 {
+		t.Error("不存在的trace应该返回404")
+	}
+}
+
+func TestMonitorTraceView(t *testing.T) {
+	mux := newTestHandler()
+	if _, err := NewMonitor(mux, "./log"); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/view/trace?id=0af7651916cd43dd8448eb211c80319c", nil))
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `traceID: "0af7651916cd43dd8448eb211c80319c"`) {
+		t.Errorf("页面渲染错误: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestMonitorLatencyTimeline(t *testing.T) {
+	mux := newTestHandler()
+	handler, err := NewMonitor(mux, "./log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := handler.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		CurrentTrace().SetRoute("/user/:id")
+	}))
+	app.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/user/1", nil))
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	// 连接建立后立即推送一次
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/metrics/latency/data", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := &LatencyTimeline{}
+	if err := json.Unmarshal(msg, res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Routes) != 1 || res.Routes[0].Route != "/user/:id" || len(res.Routes[0].Points) != 60 || res.Routes[0].Points[59].Count != 1 {
+		t.Errorf("推送数据错误: %s", msg)
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/view/latency", nil))
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "/metrics/latency/data") {
+		t.Errorf("页面渲染错误: %d", w.Code)
+	}
+}
@@ -0,0 +1,171 @@
+package localtracing
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// Option NewLocaltracing的配置项
+type Option func(*options)
+
+type options struct {
+	exporters   []Exporter
+	statsd      *StatsDEmitter
+	serviceName string
+	traceSize   int
+	traceBytes  int64
+	viewsDir    string
+	log         logOptions
+
+	panicRenderer PanicRenderer
+	repanic       bool
+	panicKeep     int
+	panicMaxAge   time.Duration
+	routeResolver RouteResolver
+}
+
+func newOptions(opts []Option) *options {
+	res := &options{
+		serviceName: defaultServiceName(),
+		traceSize:   defaultTraceStoreSize,
+		traceBytes:  defaultTraceStoreBytes,
+		log:         defaultLogOptions(),
+
+		panicRenderer: TextPanicRenderer,
+		panicKeep:     defaultPanicKeep,
+		panicMaxAge:   defaultPanicMaxAge,
+	}
+	for _, opt := range opts {
+		opt(res)
+	}
+	return res
+}
+
+// WithLogLevel 日志级别 默认为debug
+func WithLogLevel(level zapcore.Level) Option {
+	return func(o *options) {
+		o.log.level = level
+	}
+}
+
+// WithLogEncoding 日志格式 LogConsole(默认)或者LogJSON stdout以及文件使用相同的格式
+func WithLogEncoding(encoding string) Option {
+	return func(o *options) {
+		o.log.encoding = encoding
+	}
+}
+
+// WithStdout 是否输出到stdout 默认输出
+func WithStdout(enabled bool) Option {
+	return func(o *options) {
+		o.log.stdout = enabled
+	}
+}
+
+// WithLogFile 日志文件名 相对于logDir 默认base.log 为空时不写入文件
+func WithLogFile(name string) Option {
+	return func(o *options) {
+		o.log.file = name
+	}
+}
+
+// WithLogRotation 日志文件按大小切分 maxSize单位为MB(默认100)
+// maxAge为旧文件保留的天数、maxBackups为保留的旧文件数 0表示不限制
+func WithLogRotation(maxSize, maxAge, maxBackups int) Option {
+	return func(o *options) {
+		if maxSize > 0 {
+			o.log.maxSize = maxSize
+		}
+		o.log.maxAge = maxAge
+		o.log.maxBackups = maxBackups
+	}
+}
+
+// WithExporter 请求结束后将调用树交给exporter 可以设置多个
+func WithExporter(e Exporter) Option {
+	return func(o *options) {
+		if e != nil {
+			o.exporters = append(o.exporters, e)
+		}
+	}
+}
+
+// WithStatsD 将请求以及Time()函数的耗时发送到StatsD/DogStatsD
+func WithStatsD(e *StatsDEmitter) Option {
+	return func(o *options) {
+		o.statsd = e
+	}
+}
+
+// WithServiceName 服务名 用于导出的调用树 默认为程序名
+func WithServiceName(name string) Option {
+	return func(o *options) {
+		if name != "" {
+			o.serviceName = name
+		}
+	}
+}
+
+// WithTraceBuffer 内存中保存最近的请求数以及最大内存占用(估算值)
+// 默认1000个、32MB size为0时不保存 maxBytes小于等于0时不限制内存
+func WithTraceBuffer(size int, maxBytes int64) Option {
+	return func(o *options) {
+		if size >= 0 {
+			o.traceSize = size
+		}
+		o.traceBytes = maxBytes
+	}
+}
+
+// WithPanicRenderer 发生panic时的响应 默认为TextPanicRenderer
+// 可以使用ProblemJSONPanicRenderer、HTMLPanicRenderer或者自定义函数
+func WithPanicRenderer(fn PanicRenderer) Option {
+	return func(o *options) {
+		if fn != nil {
+			o.panicRenderer = fn
+		}
+	}
+}
+
+// WithRepanic 记录panic之后重新panic 由上层的recover中间件处理 此时不写入响应
+func WithRepanic() Option {
+	return func(o *options) {
+		o.repanic = true
+	}
+}
+
+// WithPanicRetention LogDir/panics下保留的报告数以及时间 超出时删除最旧的报告
+// 默认1000个、7天 0表示不限制
+func WithPanicRetention(keep int, maxAge time.Duration) Option {
+	return func(o *options) {
+		o.panicKeep = keep
+		o.panicMaxAge = maxAge
+	}
+}
+
+// RouteResolver 根据请求返回路由模板 例如/user/:id 返回空字符串时使用默认值
+type RouteResolver func(r *http.Request) string
+
+// WithRouteResolver 框架适配层以及trace.SetRoute都没有设置路由模板时 用于得到统计使用的路由
+// 默认404记为unmatched 其他请求记为unrouted
+func WithRouteResolver(fn RouteResolver) Option {
+	return func(o *options) {
+		o.routeResolver = fn
+	}
+}
+
+// WithDevViews 开发模式 从dir/views目录读取页面以及静态资源 文件修改后页面自动刷新
+// dir一般为项目的根目录 只对NewMonitor生效
+func WithDevViews(dir string) Option {
+	return func(o *options) {
+		o.viewsDir = dir
+	}
+}
+
+func defaultServiceName() string {
+	return filepath.Base(os.Args[0])
+}
@@ -0,0 +1,323 @@
+package localtracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+////////////////////
+// OTLP/HTTP导出 将请求的调用树以OTLP JSON格式批量发送到collector
+// https://opentelemetry.io/docs/specs/otlp/#otlphttp
+// 队列满或者重试后仍失败的调用树会被丢弃并计数
+////////////////////
+
+const (
+	otlpKindInternal = 1
+	otlpKindServer   = 2
+	otlpStatusError  = 2
+)
+
+// OTLPConfig OTLP导出配置 零值使用默认配置
+type OTLPConfig struct {
+	Endpoint      string            // 默认http://localhost:4318/v1/traces
+	Headers       map[string]string // 附加的请求头 例如鉴权信息
+	ServiceName   string            // 默认为程序名
+	BatchSize     int               // 每次发送的最大请求数 默认512
+	QueueSize     int               // 等待发送的最大请求数 默认2048
+	FlushInterval time.Duration     // 不足一批时的发送间隔 默认5s
+	MaxRetries    int               // 失败重试次数 默认3 小于0不重试
+	RetryBackoff  time.Duration     // 首次重试的等待时间 之后每次翻倍 默认1s
+	MaxBackoff    time.Duration     // 重试等待时间的上限 包括Retry-After 默认30s
+	Timeout       time.Duration     // 单次发送的超时时间 默认10s
+	Client        *http.Client
+}
+
+// OTLPExporter OTLP/HTTP JSON导出
+type OTLPExporter struct {
+	cfg   OTLPConfig
+	queue *asyncQueue
+}
+
+func NewOTLPExporter(cfg OTLPConfig) *OTLPExporter {
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = "http://localhost:4318/v1/traces"
+	}
+	if cfg.ServiceName == "" {
+		cfg.ServiceName = defaultServiceName()
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 512
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 2048
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = 5 * time.Second
+	}
+	if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = 3
+	}
+	if cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = time.Second
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = 30 * time.Second
+	}
+	if cfg.RetryBackoff > cfg.MaxBackoff {
+		cfg.RetryBackoff = cfg.MaxBackoff
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: cfg.Timeout}
+	}
+
+	e := &OTLPExporter{cfg: cfg, queue: newAsyncQueue(cfg.QueueSize)}
+	go e.run()
+	return e
+}
+
+// Export 加入发送队列 队列已满时丢弃
+func (e *OTLPExporter) Export(rec *TraceRecord) {
+	e.queue.push(rec)
+}
+
+// Dropped 被丢弃的请求数
+func (e *OTLPExporter) Dropped() int64 {
+	return e.queue.droppedCount()
+}
+
+// Shutdown 发送队列中剩余的数据 ctx结束时不再等待
+func (e *OTLPExporter) Shutdown(ctx context.Context) error {
+	return e.queue.shutdown(ctx)
+}
+
+func (e *OTLPExporter) run() {
+	batch := make([]*TraceRecord, 0, e.cfg.BatchSize)
+	flush := func() {
+		if len(batch) > 0 {
+			e.send(batch)
+			batch = batch[:0]
+		}
+	}
+	e.queue.run(e.cfg.FlushInterval, func(item interface{}) {
+		batch = append(batch, item.(*TraceRecord))
+		if len(batch) >= e.cfg.BatchSize {
+			flush()
+		}
+	}, flush)
+}
+
+// 发送一批数据 失败时按退避时间重试 Shutdown时不再等待 直接丢弃
+func (e *OTLPExporter) send(batch []*TraceRecord) {
+	body, err := json.Marshal(e.encode(batch))
+	if err != nil {
+		e.queue.drop(len(batch))
+		return
+	}
+
+	backoff := e.cfg.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		wait, err := e.post(body)
+		if err == nil {
+			return
+		}
+		if wait < 0 || attempt >= e.cfg.MaxRetries {
+			e.queue.drop(len(batch))
+			return
+		}
+		if wait == 0 {
+			wait = backoff
+			backoff *= 2
+		}
+		if wait > e.cfg.MaxBackoff {
+			wait = e.cfg.MaxBackoff
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-e.queue.stop:
+			timer.Stop()
+			e.queue.drop(len(batch))
+			return
+		}
+	}
+}
+
+// 返回的等待时间小于0表示不需要重试 0表示使用默认的退避时间
+func (e *OTLPExporter) post(body []byte) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), e.cfg.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.cfg.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return -1, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, val := range e.cfg.Headers {
+		req.Header.Set(key, val)
+	}
+
+	resp, err := e.cfg.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return 0, nil
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode == http.StatusBadGateway,
+		resp.StatusCode == http.StatusServiceUnavailable, resp.StatusCode == http.StatusGatewayTimeout:
+		var wait time.Duration
+		if sec, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && sec > 0 {
+			wait = time.Duration(sec) * time.Second
+		}
+		return wait, errors.New(resp.Status)
+	default:
+		return -1, errors.New(resp.Status)
+	}
+}
+
+////////////////////
+// OTLP JSON格式
+// trace id与span id为十六进制字符串 64位整数为字符串
+////////////////////
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func otlpString(key, val string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{StringValue: &val}}
+}
+
+func otlpInt(key string, val int64) otlpKeyValue {
+	s := strconv.FormatInt(val, 10)
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{IntValue: &s}}
+}
+
+func otlpAttr(key string, val interface{}) otlpKeyValue {
+	switch v := val.(type) {
+	case string:
+		return otlpString(key, v)
+	case bool:
+		return otlpKeyValue{Key: key, Value: otlpAnyValue{BoolValue: &v}}
+	case int:
+		return otlpInt(key, int64(v))
+	case int32:
+		return otlpInt(key, int64(v))
+	case int64:
+		return otlpInt(key, v)
+	case uint32:
+		return otlpInt(key, int64(v))
+	case float32:
+		f := float64(v)
+		return otlpKeyValue{Key: key, Value: otlpAnyValue{DoubleValue: &f}}
+	case float64:
+		return otlpKeyValue{Key: key, Value: otlpAnyValue{DoubleValue: &v}}
+	default:
+		return otlpString(key, fmt.Sprint(v))
+	}
+}
+
+func (e *OTLPExporter) encode(batch []*TraceRecord) *otlpRequest {
+	var spans []otlpSpan
+	for _, rec := range batch {
+		spans = appendOTLPSpans(spans, rec)
+	}
+	return &otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpKeyValue{otlpString("service.name", e.cfg.ServiceName)}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/wwqdrh/localtracing"},
+			Spans: spans,
+		}},
+	}}}
+}
+
+// 同名合并的节点使用首次调用的开始时间与累计耗时
+func appendOTLPSpans(res []otlpSpan, rec *TraceRecord) []otlpSpan {
+	rec.walk(func(span *Span, parent SpanID) {
+		start := rec.Start.Add(span.Start)
+		item := otlpSpan{
+			TraceID:           rec.TraceID.String(),
+			SpanID:            span.ID.String(),
+			Name:              span.Name,
+			Kind:              otlpKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(start.Add(span.Duration).UnixNano(), 10),
+		}
+		if parent.IsValid() {
+			item.ParentSpanID = parent.String()
+		}
+		if span == rec.Root {
+			item.Kind = otlpKindServer
+		}
+		for _, tag := range rec.tags(span) {
+			item.Attributes = append(item.Attributes, otlpAttr(tag.key, tag.val))
+		}
+		if msg, ok := rec.spanError(span); ok {
+			item.Status = otlpStatus{Code: otlpStatusError, Message: msg}
+		}
+		res = append(res, item)
+	})
+	return res
+}
@@ -0,0 +1,185 @@
+package localtracing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOTLPExporter(t *testing.T) {
+	received := make(chan *otlpRequest, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" || r.Header.Get("X-Token") != "abc" {
+			t.Errorf("请求格式错误: %s %v", r.URL.Path, r.Header)
+		}
+		req := &otlpRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			t.Error(err)
+		}
+		received <- req
+	}))
+	defer srv.Close()
+
+	exporter := NewOTLPExporter(OTLPConfig{
+		Endpoint:    srv.URL + "/v1/traces",
+		Headers:     map[string]string{"X-Token": "abc"},
+		ServiceName: "demo",
+		BatchSize:   2,
+	})
+	handler, err := NewLocaltracing("./log", WithExporter(exporter))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := handler.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		CurrentTrace().SetRoute("/user/:id")
+		defer handler.Time()()
+		if r.URL.Path == "/user/2" {
+			w.WriteHeader(503)
+		}
+	}))
+	for _, url := range []string{"/user/1", "/user/2"} {
+		req := httptest.NewRequest("GET", url, nil)
+		req.Header.Set(TraceparentHeader, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// 满一批后立即发送
+	var req *otlpRequest
+	select {
+	case req = <-received:
+	case <-time.After(3 * time.Second):
+		t.Fatal("没有收到数据")
+	}
+	res := req.ResourceSpans[0]
+	if *res.Resource.Attributes[0].Value.StringValue != "demo" {
+		t.Error("service.name错误")
+	}
+	spans := res.ScopeSpans[0].Spans
+	if len(spans) != 4 {
+		t.Fatalf("span数量错误: %d", len(spans))
+	}
+	root, child := spans[0], spans[1]
+	if root.TraceID != "0af7651916cd43dd8448eb211c80319c" || root.ParentSpanID != "b7ad6b7169203331" || root.Kind != otlpKindServer {
+		t.Errorf("根节点错误: %+v", root)
+	}
+	if child.ParentSpanID != root.SpanID || child.Kind != otlpKindInternal || child.StartTimeUnixNano > child.EndTimeUnixNano {
+		t.Errorf("子节点错误: %+v", child)
+	}
+	if root.Status.Code != 0 || spans[2].Status.Code != otlpStatusError {
+		t.Error("状态错误")
+	}
+
+	if err := handler.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if exporter.Dropped() != 0 {
+		t.Error("不应该丢弃数据")
+	}
+}
+
+func TestOTLPRetry(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch n := atomic.AddInt32(&calls, 1); {
+		case r.URL.Path == "/bad":
+			w.WriteHeader(400)
+		case n < 3:
+			w.WriteHeader(503)
+		}
+	}))
+	defer srv.Close()
+
+	exporter := NewOTLPExporter(OTLPConfig{Endpoint: srv.URL, RetryBackoff: time.Millisecond, FlushInterval: time.Millisecond})
+	exporter.Export(&TraceRecord{Root: &Span{ID: newSpanID(), Name: "GET /"}})
+	// Shutdown会中断重试 等待发送成功
+	for i := 0; i < 100 && atomic.LoadInt32(&calls) < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	exporter.Shutdown(context.Background())
+	if atomic.LoadInt32(&calls) != 3 || exporter.Dropped() != 0 {
+		t.Errorf("重试错误: calls=%d dropped=%d", calls, exporter.Dropped())
+	}
+
+	// 4xx不重试
+	atomic.StoreInt32(&calls, 0)
+	exporter = NewOTLPExporter(OTLPConfig{Endpoint: srv.URL + "/bad", RetryBackoff: time.Millisecond})
+	exporter.Export(&TraceRecord{Root: &Span{ID: newSpanID(), Name: "GET /"}})
+	exporter.Shutdown(context.Background())
+	if atomic.LoadInt32(&calls) != 1 || exporter.Dropped() != 1 {
+		t.Errorf("不应该重试: calls=%d dropped=%d", calls, exporter.Dropped())
+	}
+}
+
+func TestOTLPRetryWait(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(429)
+		}
+	}))
+	defer srv.Close()
+
+	// Retry-After不超过MaxBackoff
+	exporter := NewOTLPExporter(OTLPConfig{Endpoint: srv.URL, MaxBackoff: 10 * time.Millisecond, FlushInterval: time.Millisecond})
+	exporter.Export(&TraceRecord{Root: &Span{ID: newSpanID(), Name: "GET /"}})
+	for i := 0; i < 100 && atomic.LoadInt32(&calls) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	exporter.Shutdown(context.Background())
+	if atomic.LoadInt32(&calls) != 2 || exporter.Dropped() != 0 {
+		t.Errorf("Retry-After没有限制: calls=%d dropped=%d", calls, exporter.Dropped())
+	}
+
+	// 等待重试时Shutdown立即返回
+	atomic.StoreInt32(&calls, 0)
+	exporter = NewOTLPExporter(OTLPConfig{Endpoint: srv.URL, MaxBackoff: time.Hour, FlushInterval: time.Millisecond})
+	exporter.Export(&TraceRecord{Root: &Span{ID: newSpanID(), Name: "GET /"}})
+	for i := 0; i < 100 && atomic.LoadInt32(&calls) < 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := exporter.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if exporter.Dropped() != 1 {
+		t.Errorf("中断的数据应该丢弃: %d", exporter.Dropped())
+	}
+}
+
+func TestOTLPQueueFull(t *testing.T) {
+	received := make(chan struct{}, 10)
+	unblock := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		<-unblock
+	}))
+	defer srv.Close()
+
+	exporter := NewOTLPExporter(OTLPConfig{Endpoint: srv.URL, BatchSize: 1, QueueSize: 1})
+	newRecord := func() *TraceRecord {
+		return &TraceRecord{Root: &Span{ID: newSpanID(), Name: "GET /"}}
+	}
+	exporter.Export(newRecord())
+	<-received // 第一个正在发送
+
+	exporter.Export(newRecord()) // 进入队列
+	exporter.Export(newRecord()) // 队列已满
+	if exporter.Dropped() != 1 {
+		t.Errorf("丢弃计数错误: %d", exporter.Dropped())
+	}
+
+	close(unblock)
+	if err := exporter.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	exporter.Export(newRecord()) // 已经停止
+	if exporter.Dropped() != 2 || len(received) != 1 {
+		t.Errorf("停止后计数错误: dropped=%d sent=%d", exporter.Dropped(), len(received)+1)
+	}
+}
@@ -0,0 +1,328 @@
+package localtracing
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+////////////////////
+// panic报告 记录panic的值、错误链、调用栈以及当时的调用树
+// 每次panic写入LogDir/panics下的一个文件 监控页面可以直接打开
+// 超出保留的数量或者时间时删除最旧的文件
+////////////////////
+
+const (
+	panicDir       = "panics"
+	panicListLimit = 100 // 列表最多返回的报告数
+	maxPanicFrames = 64
+
+	defaultPanicKeep   = 1000 // 默认最多保留的报告数
+	defaultPanicMaxAge = 7 * 24 * time.Hour
+)
+
+var (
+	ErrPanicNotFound = errors.New("panic报告不存在")
+
+	// 报告id 时间加上请求的span id 同时用作文件名
+	panicIDPattern = regexp.MustCompile(`^\d{8}-\d{6}-[0-9a-f]{16}$`)
+)
+
+// PanicReport 一次panic的完整信息
+type PanicReport struct {
+	ID      string       `json:"id"`
+	Time    time.Time    `json:"time"`
+	TraceID TraceID      `json:"trace_id"`
+	SpanID  SpanID       `json:"span_id"`
+	Method  string       `json:"method"`
+	Route   string       `json:"route"`
+	URL     string       `json:"url"`
+	Value   string       `json:"value"`            // panic的值
+	Type    string       `json:"type"`             // panic值的类型
+	Errors  []PanicError `json:"errors,omitempty"` // 值为error时的错误链 由外到内
+	Frames  []PanicFrame `json:"frames"`           // 发生panic的调用栈 不含runtime
+	Stack   string       `json:"stack"`            // debug.Stack()的完整输出
+	Spans   *Span        `json:"spans,omitempty"`  // panic时请求的调用树
+
+	value interface{} // 原始的panic值 用于重新panic
+}
+
+type PanicError struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+type PanicFrame struct {
+	Function string `json:"function"`
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+}
+
+func (f PanicFrame) String() string {
+	return fmt.Sprintf("%s %s:%d", f.Function, f.File, f.Line)
+}
+
+// 在recover所在的defer中调用 skip为需要跳过的调用层数
+func newPanicReport(val interface{}, skip int) *PanicReport {
+	res := &PanicReport{
+		value: val,
+		Time:  time.Now(),
+		Value: fmt.Sprint(val),
+		Type:  fmt.Sprintf("%T", val),
+		Stack: string(debug.Stack()),
+	}
+	if err, ok := val.(error); ok {
+		for ; err != nil; err = errors.Unwrap(err) {
+			res.Errors = append(res.Errors, PanicError{Type: fmt.Sprintf("%T", err), Message: err.Error()})
+		}
+	}
+
+	pcs := make([]uintptr, maxPanicFrames)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(skip+2, pcs)])
+	for {
+		frame, more := frames.Next()
+		if !strings.HasPrefix(frame.Function, "runtime.") {
+			res.Frames = append(res.Frames, PanicFrame{Function: frame.Function, File: frame.File, Line: frame.Line})
+		}
+		if !more {
+			break
+		}
+	}
+	return res
+}
+
+// 关联请求以及当时的调用树
+func (p *PanicReport) withTrace(trace *Trace) {
+	if trace == nil {
+		return
+	}
+	p.TraceID = trace.TraceID()
+	p.SpanID = trace.SpanID()
+	p.Route = trace.Route()
+	p.Spans = trace.Tree()
+	// 请求还没有结束 根节点的耗时为到panic为止
+	p.Spans.Duration = p.Time.Sub(trace.start) - p.Spans.Start
+	p.ID = p.Time.Format("20060102-150405") + "-" + p.SpanID.String()
+}
+
+// 日志中记录的信息 完整的调用栈见报告文件
+func (p *PanicReport) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("id", p.ID)
+	enc.AddString("value", p.Value)
+	enc.AddString("type", p.Type)
+	if len(p.Errors) > 0 {
+		chain := make([]string, len(p.Errors))
+		for i, item := range p.Errors {
+			chain[i] = item.Message
+		}
+		enc.AddString("errors", strings.Join(chain, " <- "))
+	}
+	frames := make([]string, len(p.Frames))
+	for i, item := range p.Frames {
+		frames[i] = item.String()
+	}
+	enc.AddString("stack", strings.Join(frames, " <- "))
+	return nil
+}
+
+// 报告写入dir/<id>.json
+func (p *PanicReport) save(dir string) error {
+	if p.ID == "" {
+		p.ID = p.Time.Format("20060102-150405") + "-" + newSpanID().String()
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	body, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, p.ID+".json"), body, 0644)
+}
+
+func loadPanicReport(dir, id string) (*PanicReport, error) {
+	if !panicIDPattern.MatchString(id) {
+		return nil, ErrPanicNotFound
+	}
+	body, err := ioutil.ReadFile(filepath.Join(dir, id+".json"))
+	if os.IsNotExist(err) {
+		return nil, ErrPanicNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	res := &PanicReport{}
+	if err := json.Unmarshal(body, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// 报告文件的保留以及列表的索引
+// 创建时在后台读取一次目录 之后在内存中维护报告的摘要 写入以及列表不再读取目录
+type panicStore struct {
+	mu      sync.Mutex
+	dir     string
+	keep    int            // 最多保留的报告数 0为不限制
+	maxAge  time.Duration  // 报告保留的时间 0为不限制
+	ready   chan struct{}  // 已有的报告读取完成
+	reports []*PanicReport // 报告的摘要 不含调用栈以及调用树 旧的在前
+}
+
+func newPanicStore(dir string, keep int, maxAge time.Duration) *panicStore {
+	s := &panicStore{dir: dir, keep: keep, maxAge: maxAge, ready: make(chan struct{})}
+	go s.load()
+	return s
+}
+
+// 读取已有的报告 不持有锁 请求中的panic不需要等待读取完成
+func (s *panicStore) load() {
+	defer close(s.ready)
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return
+	}
+	ids := make([]string, 0, len(files))
+	for _, file := range files {
+		if id := strings.TrimSuffix(file.Name(), ".json"); panicIDPattern.MatchString(id) {
+			ids = append(ids, id)
+		}
+	}
+	// id以时间开头 按名字排序即按时间排序
+	sort.Strings(ids)
+	loaded := make([]*PanicReport, 0, len(ids))
+	for _, id := range ids {
+		if report, err := loadPanicReport(s.dir, id); err == nil {
+			loaded = append(loaded, report.summary())
+		}
+	}
+
+	// 读取期间写入的报告排在后面 目录中已经包含这些报告 需要去重
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	saved := make(map[string]bool, len(s.reports))
+	for _, report := range s.reports {
+		saved[report.ID] = true
+	}
+	res := loaded[:0]
+	for _, report := range loaded {
+		if !saved[report.ID] {
+			res = append(res, report)
+		}
+	}
+	s.reports = append(res, s.reports...)
+	s.prune(time.Now())
+}
+
+// 删除超出数量以及过期的报告
+func (s *panicStore) prune(now time.Time) {
+	n := 0
+	for ; n < len(s.reports); n++ {
+		over := s.keep > 0 && len(s.reports)-n > s.keep
+		expired := s.maxAge > 0 && now.Sub(s.reports[n].Time) > s.maxAge
+		if !over && !expired {
+			break
+		}
+		os.Remove(filepath.Join(s.dir, s.reports[n].ID+".json"))
+	}
+	s.reports = s.reports[n:]
+}
+
+// 写入报告并删除最旧的报告
+func (s *panicStore) Save(p *PanicReport) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := p.save(s.dir); err != nil {
+		return err
+	}
+	s.reports = append(s.reports, p.summary())
+	s.prune(p.Time)
+	return nil
+}
+
+// 最近的报告 新的在前 不含调用栈以及调用树
+func (s *panicStore) List(limit int) []*PanicReport {
+	res := []*PanicReport{}
+	if s == nil {
+		return res
+	}
+	<-s.ready
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(time.Now())
+	for i := len(s.reports) - 1; i >= 0 && (limit <= 0 || len(res) < limit); i-- {
+		res = append(res, s.reports[i])
+	}
+	return res
+}
+
+func (s *panicStore) Get(id string) (*PanicReport, error) {
+	if s == nil {
+		return nil, ErrPanicNotFound
+	}
+	return loadPanicReport(s.dir, id)
+}
+
+func (p *PanicReport) summary() *PanicReport {
+	res := *p
+	res.Stack, res.Spans = "", nil
+	return &res
+}
+
+// PanicRenderer 发生panic并且响应还没有开始写入时 用于写入错误响应
+type PanicRenderer func(w http.ResponseWriter, r *http.Request, report *PanicReport)
+
+// TextPanicRenderer 默认的响应 500 found error
+func TextPanicRenderer(w http.ResponseWriter, r *http.Request, report *PanicReport) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write([]byte("found error"))
+}
+
+// ProblemJSONPanicRenderer RFC 7807 application/problem+json 不包含panic的值以免泄露内部信息
+func ProblemJSONPanicRenderer(w http.ResponseWriter, r *http.Request, report *PanicReport) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"type":     "about:blank",
+		"title":    http.StatusText(http.StatusInternalServerError),
+		"status":   http.StatusInternalServerError,
+		"instance": r.URL.RequestURI(),
+		"trace_id": report.TraceID,
+		"panic_id": report.ID,
+	})
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write(body)
+}
+
+var panicPage = template.Must(template.New("panic").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="UTF-8"><title>500 Internal Server Error</title></head>
+<body>
+<h1>500 Internal Server Error</h1>
+<p>trace id: {{ .TraceID }}</p>
+</body>
+</html>
+`))
+
+// HTMLPanicRenderer 简单的错误页面 显示trace id便于查找日志
+func HTMLPanicRenderer(w http.ResponseWriter, r *http.Request, report *PanicReport) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusInternalServerError)
+	panicPage.Execute(w, report)
+}
@@ -0,0 +1,307 @@
+package localtracing
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func panicHandler(handler *LocalTracing) http.Handler {
+	return handler.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		CurrentTrace().SetRoute("/order/:id")
+		func() {
+			defer handler.Time()()
+		}()
+		panic(fmt.Errorf("load order: %w", io.ErrUnexpectedEOF))
+	}))
+}
+
+func TestPanicReport(t *testing.T) {
+	logDir := t.TempDir()
+	mux := newTestHandler()
+	handler, err := NewMonitor(mux, logDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	panicHandler(handler).ServeHTTP(w, httptest.NewRequest("GET", "/order/1?a=b", nil))
+	if w.Code != 500 {
+		t.Errorf("状态码错误: %d", w.Code)
+	}
+
+	recs := handler.RecentTraces()
+	if len(recs) != 1 || !recs[0].Panic || recs[0].PanicID == "" {
+		t.Fatal("调用树没有关联panic报告")
+	}
+	id := recs[0].PanicID
+	if _, err := os.Stat(filepath.Join(logDir, "panics", id+".json")); err != nil {
+		t.Fatal("报告文件不存在", err)
+	}
+
+	report, err := handler.PanicReport(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Value != "load order: unexpected EOF" || report.Type != "*fmt.wrapError" {
+		t.Errorf("panic值错误: %s %s", report.Value, report.Type)
+	}
+	if len(report.Errors) != 2 || report.Errors[1].Message != "unexpected EOF" {
+		t.Errorf("错误链错误: %v", report.Errors)
+	}
+	if len(report.Frames) == 0 || report.Frames[0].Function != "github.com/wwqdrh/localtracing.panicHandler.func1" {
+		t.Errorf("调用栈错误: %v", report.Frames)
+	}
+	if !strings.Contains(report.Stack, "goroutine") || !strings.Contains(report.Stack, "panicHandler") {
+		t.Error("缺少完整的调用栈")
+	}
+	if report.TraceID != recs[0].TraceID || report.Route != "/order/:id" || report.URL != "/order/1?a=b" {
+		t.Errorf("请求信息错误: %+v", report)
+	}
+	if report.Spans == nil || len(report.Spans.Children) != 1 || report.Spans.Duration <= 0 {
+		t.Error("调用树错误")
+	}
+
+	// 监控接口
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/panic/list", nil))
+	list := struct {
+		Panics []*PanicReport `json:"panics"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Panics) != 1 || list.Panics[0].ID != id || list.Panics[0].Stack != "" {
+		t.Errorf("列表错误: %s", w.Body.String())
+	}
+	for url, code := range map[string]int{
+		"/panic/" + id: 200,
+		"/panic/20220101-000000-0000000000000000": 404,
+		"/panic/..%2Fbase.log":                    404,
+		"/view/panic?id=" + id:                    200,
+	} {
+		w = httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		if w.Code != code {
+			t.Errorf("%s 状态码错误: %d", url, w.Code)
+		}
+	}
+}
+
+func TestPanicRenderer(t *testing.T) {
+	for name, item := range map[string]struct {
+		opts        []Option
+		contentType string
+		body        string
+	}{
+		"text":    {nil, "text/plain; charset=utf-8", "found error"},
+		"problem": {[]Option{WithPanicRenderer(ProblemJSONPanicRenderer)}, "application/problem+json", `"status":500`},
+		"html":    {[]Option{WithPanicRenderer(HTMLPanicRenderer)}, "text/html; charset=utf-8", "<h1>500 Internal Server Error</h1>"},
+		"custom": {[]Option{WithPanicRenderer(func(w http.ResponseWriter, r *http.Request, report *PanicReport) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(503)
+			json.NewEncoder(w).Encode(map[string]string{"code": "E_PANIC", "trace_id": report.TraceID.String()})
+		})}, "application/json", `"code":"E_PANIC"`},
+	} {
+		handler, err := NewLocaltracing(t.TempDir(), item.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		app := handler.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Length", "1024")
+			panic("boom")
+		}))
+		w := httptest.NewRecorder()
+		app.ServeHTTP(w, httptest.NewRequest("GET", "/api/order", nil))
+		if w.Header().Get("Content-Type") != item.contentType || w.Header().Get("Content-Length") != "" {
+			t.Errorf("%s 响应头错误: %v", name, w.Header())
+		}
+		if !strings.Contains(w.Body.String(), item.body) {
+			t.Errorf("%s 响应错误: %s", name, w.Body.String())
+		}
+		if name == "custom" && w.Code != 503 || name != "custom" && w.Code != 500 {
+			t.Errorf("%s 状态码错误: %d", name, w.Code)
+		}
+		if name == "problem" {
+			problem := map[string]interface{}{}
+			if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+				t.Fatal(err)
+			}
+			if problem["instance"] != "/api/order" || problem["trace_id"] == "" || strings.Contains(w.Body.String(), "boom") {
+				t.Errorf("problem+json错误: %s", w.Body.String())
+			}
+		}
+	}
+}
+
+// 响应已经开始写入时保留已写入的内容 不再追加错误响应
+func TestPanicResponseStarted(t *testing.T) {
+	handler, err := NewLocaltracing(t.TempDir(), WithPanicRenderer(ProblemJSONPanicRenderer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := handler.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(202)
+		w.Write([]byte(`{"items":[`))
+		panic("boom")
+	}))
+	w := httptest.NewRecorder()
+	func() {
+		// 记录之后中断连接
+		defer func() {
+			if val := recover(); val != http.ErrAbortHandler {
+				t.Errorf("没有中断连接: %v", val)
+			}
+		}()
+		app.ServeHTTP(w, httptest.NewRequest("GET", "/stream", nil))
+	}()
+	if w.Code != 202 || w.Body.String() != `{"items":[` {
+		t.Errorf("响应被修改: %d %s", w.Code, w.Body.String())
+	}
+	if recs := handler.RecentTraces(); len(recs) != 1 || !recs[0].Panic || !recs[0].Failed() {
+		t.Error("没有记录为失败的请求")
+	}
+	if reports, _ := handler.PanicReports(); len(reports) != 1 {
+		t.Errorf("没有记录panic报告: %d", len(reports))
+	}
+}
+
+// handler主动中断连接 不记录为panic
+func TestPanicAbortHandler(t *testing.T) {
+	handler, err := NewLocaltracing(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := handler.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	w := httptest.NewRecorder()
+	func() {
+		defer func() {
+			if val := recover(); val != http.ErrAbortHandler {
+				t.Errorf("没有重新panic http.ErrAbortHandler: %v", val)
+			}
+		}()
+		app.ServeHTTP(w, httptest.NewRequest("GET", "/download", nil))
+	}()
+	if w.Body.Len() != 0 {
+		t.Errorf("不应该写入错误响应: %s", w.Body.String())
+	}
+	if reports, _ := handler.PanicReports(); len(reports) != 0 {
+		t.Errorf("不应该记录panic报告: %d", len(reports))
+	}
+	for _, group := range handler.ErrorGroups() {
+		if group.Kind == errorKindPanic {
+			t.Errorf("不应该计入错误分组: %s", group.Message)
+		}
+	}
+}
+
+func TestRepanic(t *testing.T) {
+	handler, err := NewLocaltracing(t.TempDir(), WithRepanic())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cause := fmt.Errorf("load order: %w", io.ErrUnexpectedEOF)
+	app := handler.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(cause)
+	}))
+
+	w := httptest.NewRecorder()
+	func() {
+		defer func() {
+			if val := recover(); val != cause {
+				t.Errorf("没有重新panic原始的值: %v", val)
+			}
+		}()
+		app.ServeHTTP(w, httptest.NewRequest("GET", "/order/1", nil))
+	}()
+	if w.Body.Len() != 0 {
+		t.Errorf("重新panic时不应该写入响应: %s", w.Body.String())
+	}
+	recs := handler.RecentTraces()
+	if len(recs) != 1 || recs[0].PanicID == "" {
+		t.Fatal("重新panic之前没有记录调用树")
+	}
+	if _, err := handler.PanicReport(recs[0].PanicID); err != nil {
+		t.Error(err)
+	}
+}
+
+// 超出保留的数量以及时间时删除最旧的报告 已有的报告在启动后读取一次
+func TestPanicRetention(t *testing.T) {
+	logDir := t.TempDir()
+	dir := filepath.Join(logDir, "panics")
+	old := &PanicReport{Time: time.Now().Add(-48 * time.Hour), Value: "old"}
+	if err := old.save(dir); err != nil {
+		t.Fatal(err)
+	}
+	kept := &PanicReport{Time: time.Now().Add(-time.Hour), Value: "kept"}
+	if err := kept.save(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	handler, err := NewLocaltracing(logDir, WithPanicRetention(3, 24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reports, _ := handler.PanicReports()
+	if len(reports) != 1 || reports[0].ID != kept.ID {
+		t.Fatalf("过期的报告没有删除: %v", reports)
+	}
+	if _, err := os.Stat(filepath.Join(dir, old.ID+".json")); !os.IsNotExist(err) {
+		t.Error("过期的报告文件没有删除")
+	}
+
+	app := panicHandler(handler)
+	for i := 0; i < 5; i++ {
+		app.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", fmt.Sprintf("/order/%d", i), nil))
+	}
+	reports, _ = handler.PanicReports()
+	files, _ := ioutil.ReadDir(dir)
+	if len(reports) != 3 || len(files) != 3 {
+		t.Fatalf("报告数量错误: %d %d", len(reports), len(files))
+	}
+	if reports[0].URL != "/order/4" || reports[2].URL != "/order/2" || reports[0].Stack != "" {
+		t.Errorf("列表顺序错误: %s %s", reports[0].URL, reports[2].URL)
+	}
+	if _, err := handler.PanicReport(kept.ID); err != ErrPanicNotFound {
+		t.Error("超出数量的报告没有删除")
+	}
+}
+
+// 写入报告不等待已有报告的读取 读取完成后合并并且不重复
+func TestPanicStoreLoad(t *testing.T) {
+	dir := t.TempDir()
+	old := &PanicReport{Time: time.Now().Add(-time.Hour), Value: "old"}
+	if err := old.save(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &panicStore{dir: dir, ready: make(chan struct{})}
+	done := make(chan struct{})
+	report := &PanicReport{Time: time.Now(), Value: "new"}
+	go func() {
+		s.Save(report)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("写入报告时等待了目录的读取")
+	}
+
+	s.load()
+	reports := s.List(0)
+	if len(reports) != 2 || reports[0].ID != report.ID || reports[1].ID != old.ID {
+		t.Errorf("合并后的报告错误: %v", reports)
+	}
+}
@@ -0,0 +1,98 @@
+package localtracing
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// 包装ResponseWriter 记录状态码、响应大小以及首字节时间
+type responseRecorder struct {
+	http.ResponseWriter
+
+	start       time.Time
+	status      int
+	size        int
+	firstByte   time.Duration
+	wroteHeader bool
+}
+
+// 框架自身的ResponseWriter可能绕过包装直接写入(例如gin的404)
+// 此时从原始writer中读取状态码
+type statusWriter interface {
+	Status() int
+}
+
+func newResponseRecorder(w http.ResponseWriter, start time.Time) *responseRecorder {
+	return &responseRecorder{ResponseWriter: w, start: start}
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	if !r.wroteHeader {
+		r.status = code
+		r.firstByte = time.Since(r.start)
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.size += n
+	return n, err
+}
+
+func (r *responseRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		if !r.wroteHeader {
+			r.WriteHeader(http.StatusOK)
+		}
+		f.Flush()
+	}
+}
+
+// 支持websocket等协议升级
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("responsewriter不支持hijack")
+	}
+	if !r.wroteHeader {
+		r.status = http.StatusSwitchingProtocols
+		r.firstByte = time.Since(r.start)
+		r.wroteHeader = true
+	}
+	return h.Hijack()
+}
+
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// 响应是否已经开始写入
+func (r *responseRecorder) Written() bool {
+	return r.wroteHeader
+}
+
+func (r *responseRecorder) Status() int {
+	if r.wroteHeader {
+		return r.status
+	}
+	if w, ok := r.ResponseWriter.(statusWriter); ok && w.Status() > 0 {
+		return w.Status()
+	}
+	return http.StatusOK
+}
+
+func (r *responseRecorder) Size() int {
+	return r.size
+}
+
+func (r *responseRecorder) FirstByte() time.Duration {
+	return r.firstByte
+}
@@ -0,0 +1,45 @@
+package localtracing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestResponseRecorder(t *testing.T) {
+	w := httptest.NewRecorder()
+	rw := newResponseRecorder(w, time.Now())
+	if rw.Written() || rw.Status() != 200 {
+		t.Error("未写入时状态错误")
+	}
+
+	rw.WriteHeader(http.StatusNotFound)
+	rw.WriteHeader(http.StatusOK) // 重复写入以第一次为准
+	rw.Write([]byte("not found"))
+	if rw.Status() != http.StatusNotFound || rw.Size() != 9 {
+		t.Errorf("记录错误: status=%d size=%d", rw.Status(), rw.Size())
+	}
+	if rw.FirstByte() <= 0 {
+		t.Error("没有记录首字节时间")
+	}
+
+	rw = newResponseRecorder(httptest.NewRecorder(), time.Now())
+	rw.Write([]byte("ok"))
+	if rw.Status() != http.StatusOK {
+		t.Error("直接Write时状态码应该为200")
+	}
+}
+
+type fakeStatusWriter struct {
+	http.ResponseWriter
+}
+
+func (fakeStatusWriter) Status() int { return http.StatusNotFound }
+
+func TestResponseRecorderFallback(t *testing.T) {
+	rw := newResponseRecorder(fakeStatusWriter{httptest.NewRecorder()}, time.Now())
+	if rw.Status() != http.StatusNotFound {
+		t.Error("没有读取原始writer的状态码")
+	}
+}
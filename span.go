@@ -0,0 +1,278 @@
+package localtracing
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+////////////////////
+// 调用链路 每个请求维护一棵span树
+// 记录每个函数的父节点、相对请求开始的偏移、耗时以及调用次数
+////////////////////
+
+// Span 调用树中的一个节点
+type Span struct {
+	ID       SpanID                 `json:"id"`
+	Name     string                 `json:"name"`
+	Start    time.Duration          `json:"start"`           // 相对请求开始的偏移(首次调用)
+	Duration time.Duration          `json:"duration"`        // 累计耗时
+	Count    int                    `json:"count"`           // 调用次数
+	Track    int                    `json:"track,omitempty"` // 所在协程 0为请求协程 其余为Go/Restore创建的子协程
+	Attrs    map[string]interface{} `json:"attrs,omitempty"` // 附加信息 例如出站请求的状态码
+	Error    string                 `json:"error,omitempty"`
+	Children []*Span                `json:"children,omitempty"`
+
+	parent *Span
+}
+
+// Trace 单个请求的调用树
+type Trace struct {
+	mu      sync.Mutex
+	start   time.Time
+	root    *Span
+	current *Span  // 当前正在执行的节点
+	route   string // 匹配到的路由模板 由框架适配层设置
+
+	goroutine uint64 // 请求协程的id 由中间件设置 通过ctx读写上下文时不再获取
+
+	// W3C Trace Context
+	traceID    TraceID
+	parentID   SpanID // 上游服务的span id
+	flags      byte
+	traceState string
+
+	// 子协程的调用树 在读取时合并到parentSpan下
+	parent     *Trace
+	parentSpan *Span
+	forks      []*Trace
+	tracks     int32 // 请求内已分配的协程编号 只在请求的调用树上使用
+}
+
+func NewTrace(name string) *Trace {
+	root := &Span{ID: newSpanID(), Name: name, Count: 1}
+	return &Trace{
+		start:   time.Now(),
+		root:    root,
+		current: root,
+		traceID: newTraceID(),
+		flags:   flagSampled,
+	}
+}
+
+// 在当前节点下开启一个子节点，返回结束函数
+// 同一父节点下同名的调用会合并到同一个节点并累加次数与耗时
+func (t *Trace) StartSpan(name string) func() {
+	start := time.Now()
+
+	t.mu.Lock()
+	parent := t.current
+	span := parent.child(name, start.Sub(t.start))
+	span.Count++
+	t.current = span
+	t.mu.Unlock()
+
+	return func() {
+		elapsed := time.Since(start)
+
+		t.mu.Lock()
+		span.Duration += elapsed
+		if t.current == span {
+			t.current = parent
+		}
+		t.mu.Unlock()
+	}
+}
+
+// 在parent节点下开启子节点 不改变当前节点 用于通过context传递的调用链
+// parent为nil时挂在当前节点下
+func (t *Trace) startSpanAt(parent *Span, name string) (*Span, func()) {
+	start := time.Now()
+
+	t.mu.Lock()
+	if parent == nil {
+		parent = t.current
+	}
+	span := parent.child(name, start.Sub(t.start))
+	span.Count++
+	t.mu.Unlock()
+
+	return span, func() {
+		elapsed := time.Since(start)
+
+		t.mu.Lock()
+		span.Duration += elapsed
+		t.mu.Unlock()
+	}
+}
+
+// 在parent节点下添加一个独立的节点 不与同名节点合并 用于记录每一次出站请求、查询
+func (t *Trace) addSpanAt(parent *Span, name string) *Span {
+	start := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if parent == nil {
+		parent = t.current
+	}
+	span := &Span{ID: newSpanID(), Name: name, Start: start.Sub(t.start), Count: 1, Track: parent.Track, parent: parent}
+	parent.Children = append(parent.Children, span)
+	return span
+}
+
+// 设置请求匹配到的路由模板 例如/user/:id
+func (t *Trace) SetRoute(route string) {
+	t.mu.Lock()
+	t.route = route
+	t.mu.Unlock()
+}
+
+func (t *Trace) Route() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.route
+}
+
+// 为子协程创建调用树 节点挂在parent下
+func (t *Trace) fork(parent *Span) *Trace {
+	req := t
+	for req.parent != nil {
+		req = req.parent
+	}
+	track := int(atomic.AddInt32(&req.tracks, 1))
+
+	root := &Span{ID: newSpanID(), Name: "goroutine", Start: time.Since(t.start), Count: 1, Track: track}
+	child := &Trace{
+		start:      t.start,
+		root:       root,
+		current:    root,
+		parent:     t,
+		parentSpan: parent,
+	}
+
+	t.mu.Lock()
+	t.forks = append(t.forks, child)
+	child.traceID, child.parentID, child.flags, child.traceState = t.traceID, t.parentID, t.flags, t.traceState
+	t.mu.Unlock()
+	return child
+}
+
+func (t *Trace) currentSpan() *Span {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.current
+}
+
+// 请求结束 记录根节点耗时
+func (t *Trace) Finish() {
+	t.mu.Lock()
+	t.root.Duration = time.Since(t.start) - t.root.Start
+	t.mu.Unlock()
+}
+
+// 请求总耗时 Finish之后有效
+func (t *Trace) Duration() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.root.Duration
+}
+
+// 调用树的拷贝，可以安全地在其他协程中读取
+// 子协程中记录的节点会合并到创建它时所在的节点下
+func (t *Trace) Tree() *Span {
+	mapping := map[*Span]*Span{}
+	t.mu.Lock()
+	root := t.root.clone(nil, mapping)
+	forks := append([]*Trace(nil), t.forks...)
+	t.mu.Unlock()
+
+	for _, fork := range forks {
+		parent, ok := mapping[fork.parentSpan]
+		if !ok {
+			parent = root
+		}
+		sub := fork.Tree()
+		sub.parent = parent
+		parent.Children = append(parent.Children, sub)
+	}
+	return root
+}
+
+func (s *Span) child(name string, offset time.Duration) *Span {
+	for _, item := range s.Children {
+		if item.Name == name {
+			return item
+		}
+	}
+	span := &Span{ID: newSpanID(), Name: name, Start: offset, Track: s.Track, parent: s}
+	s.Children = append(s.Children, span)
+	return span
+}
+
+func (s *Span) clone(parent *Span, mapping map[*Span]*Span) *Span {
+	res := &Span{
+		ID:       s.ID,
+		Name:     s.Name,
+		Start:    s.Start,
+		Duration: s.Duration,
+		Count:    s.Count,
+		Track:    s.Track,
+		Error:    s.Error,
+		parent:   parent,
+	}
+	if len(s.Attrs) > 0 {
+		res.Attrs = make(map[string]interface{}, len(s.Attrs))
+		for key, val := range s.Attrs {
+			res.Attrs[key] = val
+		}
+	}
+	mapping[s] = res
+	for _, item := range s.Children {
+		res.Children = append(res.Children, item.clone(res, mapping))
+	}
+	return res
+}
+
+// Parent 父节点 根节点返回nil
+func (s *Span) Parent() *Span {
+	return s.parent
+}
+
+func (s *Span) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("name", s.Name)
+	enc.AddFloat64("start_ms", durationMs(s.Start))
+	enc.AddFloat64("duration_ms", durationMs(s.Duration))
+	enc.AddInt("count", s.Count)
+	if s.Track > 0 {
+		enc.AddInt("track", s.Track)
+	}
+	if len(s.Attrs) > 0 {
+		if err := enc.AddReflected("attrs", s.Attrs); err != nil {
+			return err
+		}
+	}
+	if s.Error != "" {
+		enc.AddString("error", s.Error)
+	}
+	if len(s.Children) > 0 {
+		return enc.AddArray("children", spans(s.Children))
+	}
+	return nil
+}
+
+type spans []*Span
+
+func (s spans) MarshalLogArray(enc zapcore.ArrayEncoder) error {
+	for _, item := range s {
+		if err := enc.AppendObject(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,74 @@
+package localtracing
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTraceTree(t *testing.T) {
+	trace := NewTrace("GET /tree")
+
+	handleB := func() {
+		defer trace.StartSpan("handleB")()
+		time.Sleep(10 * time.Millisecond)
+	}
+	handleA := func() {
+		defer trace.StartSpan("handleA")()
+		time.Sleep(20 * time.Millisecond)
+		handleB()
+		handleB()
+	}
+	handleA()
+	trace.Finish()
+
+	root := trace.Tree()
+	if len(root.Children) != 1 || root.Children[0].Name != "handleA" {
+		t.Fatal("根节点下的调用错误")
+	}
+	a := root.Children[0]
+	if len(a.Children) != 1 || a.Children[0].Name != "handleB" {
+		t.Fatal("handleB应该是handleA的子节点")
+	}
+	b := a.Children[0]
+	if b.Count != 2 {
+		t.Errorf("handleB调用次数错误: %d", b.Count)
+	}
+	if b.Parent() != a {
+		t.Error("父节点错误")
+	}
+	if b.Start < a.Start+20*time.Millisecond {
+		t.Error("handleB的偏移应该在handleA之后")
+	}
+	if a.Duration < b.Duration || root.Duration < a.Duration {
+		t.Error("父节点耗时应该大于子节点")
+	}
+}
+
+func TestTimeWithTrace(t *testing.T) {
+	handler := &LocalTracing{}
+	wait := sync.WaitGroup{}
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		defer ClearContext()
+
+		trace := NewTrace("GET /time")
+		setCurrentTrace(trace)
+		func() {
+			defer handler.Time()()
+			func() {
+				defer handler.Time()()
+			}()
+		}()
+
+		root := trace.Tree()
+		if len(root.Children) != 1 || len(root.Children[0].Children) != 1 {
+			t.Error("Time没有记录嵌套调用")
+		}
+		if GetContextJson() != "{}" {
+			t.Error("调用树不应该出现在上下文数据中")
+		}
+	}()
+	wait.Wait()
+}
@@ -0,0 +1,121 @@
+package localtracing
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+////////////////////
+// 基于context.Context传递调用链
+// 交给其他协程执行的任务(errgroup、协程池等)只要传递ctx就能记录到同一个请求中
+// 协程上下文(GoroutineID)只作为旧调用方式的兜底
+////////////////////
+
+type spanCtxKey struct{}
+
+type spanCtxValue struct {
+	trace *Trace
+	span  *Span // 当前节点 新的节点挂在它下面
+}
+
+// NewContext 将调用树放入ctx 后续节点挂在根节点下
+func NewContext(ctx context.Context, trace *Trace) context.Context {
+	return context.WithValue(ctx, spanCtxKey{}, &spanCtxValue{trace: trace, span: trace.root})
+}
+
+// FromContext 获取ctx中的调用树 不存在返回nil
+func FromContext(ctx context.Context) *Trace {
+	if val, ok := ctx.Value(spanCtxKey{}).(*spanCtxValue); ok {
+		return val.trace
+	}
+	return nil
+}
+
+// StartSpan 在ctx的当前节点下开启子节点，返回携带该节点的ctx以及结束函数
+// ctx中没有调用树时使用当前协程上下文中的调用树
+func StartSpan(ctx context.Context, name string) (context.Context, func()) {
+	trace, parent := spanFromContext(ctx)
+	if trace == nil {
+		return ctx, func() {}
+	}
+
+	span, end := trace.startSpanAt(parent, name)
+	return context.WithValue(ctx, spanCtxKey{}, &spanCtxValue{trace: trace, span: span}), end
+}
+
+// InjectHeaders 为出站请求设置traceparent、tracestate 父节点为ctx中的当前节点
+func InjectHeaders(ctx context.Context, h http.Header) {
+	if trace, span := spanFromContext(ctx); trace != nil {
+		trace.inject(span, h)
+	}
+}
+
+// 获取ctx中的调用树与当前节点 ctx中没有时使用协程上下文中的调用树(节点为nil)
+func spanFromContext(ctx context.Context) (*Trace, *Span) {
+	if ctx != nil {
+		if val, ok := ctx.Value(spanCtxKey{}).(*spanCtxValue); ok {
+			return val.trace, val.span
+		}
+	}
+	return CurrentTrace(), nil
+}
+
+// Operation 一次独立的调用(出站请求、数据库查询等) 不与同名节点合并
+// 可以记录附加信息与错误 nil时所有方法都不做处理
+type Operation struct {
+	trace *Trace
+	span  *Span
+	start time.Time
+	ended bool
+}
+
+// StartOperation 在ctx的当前节点下开始一次独立的调用
+// ctx以及当前协程都没有调用树时返回nil
+func StartOperation(ctx context.Context, name string) (context.Context, *Operation) {
+	trace, parent := spanFromContext(ctx)
+	if trace == nil {
+		return ctx, nil
+	}
+
+	op := &Operation{trace: trace, span: trace.addSpanAt(parent, name), start: time.Now()}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return context.WithValue(ctx, spanCtxKey{}, &spanCtxValue{trace: trace, span: op.span}), op
+}
+
+func (o *Operation) SetAttr(key string, val interface{}) {
+	if o == nil {
+		return
+	}
+	o.trace.mu.Lock()
+	defer o.trace.mu.Unlock()
+	if o.span.Attrs == nil {
+		o.span.Attrs = map[string]interface{}{}
+	}
+	o.span.Attrs[key] = val
+}
+
+func (o *Operation) SetError(err error) {
+	if o == nil || err == nil {
+		return
+	}
+	o.trace.mu.Lock()
+	defer o.trace.mu.Unlock()
+	o.span.Error = err.Error()
+}
+
+// End 结束调用并记录耗时 重复调用只记录第一次
+func (o *Operation) End() {
+	if o == nil {
+		return
+	}
+	elapsed := time.Since(o.start)
+	o.trace.mu.Lock()
+	defer o.trace.mu.Unlock()
+	if !o.ended {
+		o.span.Duration = elapsed
+		o.ended = true
+	}
+}
@@ -0,0 +1,95 @@
+package localtracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestStartSpanFanOut(t *testing.T) {
+	trace := NewTrace("GET /fanout")
+	ctx := NewContext(context.Background(), trace)
+	if FromContext(ctx) != trace {
+		t.Fatal("ctx中没有调用树")
+	}
+
+	ctx, end := StartSpan(ctx, "parent")
+	wait := sync.WaitGroup{}
+	for i := 0; i < 3; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			ctx, end := StartSpan(ctx, "worker")
+			defer end()
+			_, end2 := StartSpan(ctx, "query")
+			end2()
+		}()
+	}
+	wait.Wait()
+	end()
+
+	root := trace.Tree()
+	if len(root.Children) != 1 || root.Children[0].Name != "parent" {
+		t.Fatal("parent节点错误")
+	}
+	worker := root.Children[0].Children
+	if len(worker) != 1 || worker[0].Count != 3 {
+		t.Fatal("其他协程中的节点没有记录到请求中")
+	}
+	if len(worker[0].Children) != 1 || worker[0].Children[0].Count != 3 {
+		t.Error("嵌套节点错误")
+	}
+}
+
+func TestStartSpanWithoutTrace(t *testing.T) {
+	ctx := context.Background()
+	if FromContext(ctx) != nil {
+		t.Error("空ctx不应该有调用树")
+	}
+	newCtx, end := StartSpan(ctx, "noop")
+	end()
+	if newCtx != ctx {
+		t.Error("没有调用树时不应该创建节点")
+	}
+
+	// 兜底使用协程上下文
+	wait := sync.WaitGroup{}
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		defer ClearContext()
+		trace := NewTrace("legacy")
+		setCurrentTrace(trace)
+		_, end := StartSpan(context.Background(), "legacy")
+		end()
+		if len(trace.Tree().Children) != 1 {
+			t.Error("没有使用协程上下文中的调用树")
+		}
+	}()
+	wait.Wait()
+}
+
+func TestMiddlewareContext(t *testing.T) {
+	handler := &LocalTracing{Logger: zap.NewNop(), latency: newLatencyStats()}
+	var trace *Trace
+	r := handler.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		trace = FromContext(r.Context())
+		ctx, end := handler.TimeCtx(r.Context())
+		defer end()
+		_, end2 := handler.TimeCtx(ctx)
+		end2()
+	}))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/ctx", nil))
+
+	if trace == nil {
+		t.Fatal("中间件没有在r.Context()中设置调用树")
+	}
+	root := trace.Tree()
+	if len(root.Children) != 1 || len(root.Children[0].Children) != 1 {
+		t.Error("TimeCtx没有记录嵌套调用")
+	}
+}
@@ -0,0 +1,124 @@
+package sqltrace
+
+import (
+	"strings"
+)
+
+// Normalize 规范化sql语句 用于记录以及聚合
+// 字符串、数字以及十六进制(0x1F)常量替换为?，占位符?、$1保持不变，合并空白字符，IN (?, ?, ...)合并为IN (?)
+// 双引号为标识符 原样保留
+func Normalize(query string) string {
+	// 字符串中的\'在MySQL中为转义 在Postgres中\是普通字符
+	// 先按照转义处理 字符串没有结束时说明不是转义 重新按照标准SQL处理
+	if res, ok := normalize(query, true); ok {
+		return res
+	}
+	res, _ := normalize(query, false)
+	return res
+}
+
+// ok为false表示有没有结束的字符串
+func normalize(query string, backslash bool) (string, bool) {
+	var (
+		b       strings.Builder
+		space   bool
+		inIdent bool // 标识符中的数字不替换 例如t1
+	)
+	b.Grow(len(query))
+
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			space = b.Len() > 0
+			inIdent = false
+			continue
+		case c == '\'':
+			// 跳过字符串 支持''转义
+			closed := false
+			for i++; i < len(query); i++ {
+				if query[i] == '\\' && backslash {
+					i++
+				} else if query[i] == '\'' {
+					if i+1 < len(query) && query[i+1] == '\'' {
+						i++
+						continue
+					}
+					closed = true
+					break
+				}
+			}
+			if !closed {
+				return "", false
+			}
+			c = '?'
+		case c == '"':
+			end := strings.IndexByte(query[i+1:], '"')
+			if end < 0 {
+				end = len(query) - i - 2
+			}
+			if space {
+				b.WriteByte(' ')
+				space = false
+			}
+			b.WriteString(query[i : i+end+1])
+			i += end + 1
+			if i >= len(query) {
+				return b.String(), true
+			}
+		case c == '0' && !inIdent && i+2 < len(query) && (query[i+1] == 'x' || query[i+1] == 'X') && isHex(query[i+2]):
+			i += 2
+			for i+1 < len(query) && isHex(query[i+1]) {
+				i++
+			}
+			c = '?'
+		case c >= '0' && c <= '9' && !inIdent:
+			for i+1 < len(query) && (query[i+1] >= '0' && query[i+1] <= '9' || query[i+1] == '.') {
+				i++
+			}
+			c = '?'
+		}
+
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteByte(c)
+		// $1之类的占位符与标识符相同 其中的数字不替换
+		inIdent = c == '_' || c == '$' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' && inIdent
+	}
+	return collapseIn(b.String()), true
+}
+
+func isHex(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+// 将(?, ?, ?)合并为(?)
+func collapseIn(query string) string {
+	var b strings.Builder
+	b.Grow(len(query))
+	for i := 0; i < len(query); i++ {
+		b.WriteByte(query[i])
+		if query[i] != '(' {
+			continue
+		}
+		j := i + 1
+		n := 0
+		for j < len(query) {
+			if query[j] == '?' {
+				n++
+				j++
+			} else if query[j] == ',' || query[j] == ' ' {
+				j++
+			} else {
+				break
+			}
+		}
+		if n > 1 && j < len(query) && query[j] == ')' {
+			b.WriteByte('?')
+			i = j - 1
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,441 @@
+// database/sql驱动包装 将每一次Exec、Query、Prepare以及事务记录为当前请求调用树的节点
+//
+//	sql.Register("mysql-trace", sqltrace.Wrap(&mysql.MySQLDriver{}))
+//	db, _ := sql.Open("mysql-trace", dsn)
+//	db.QueryContext(r.Context(), "select ...")
+package sqltrace
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+
+	"github.com/wwqdrh/localtracing"
+)
+
+// Wrap 包装驱动
+func Wrap(d driver.Driver) driver.Driver {
+	return &tracedDriver{base: d}
+}
+
+// 开始一次sql调用 name为语句的类型 例如SELECT
+func start(ctx context.Context, name, query string) *localtracing.Operation {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	_, op := localtracing.StartOperation(ctx, "SQL "+name)
+	// 没有调用树时不需要规范化
+	if op != nil && query != "" {
+		op.SetAttr("db.statement", Normalize(query))
+	}
+	return op
+}
+
+// 结束调用 driver.ErrSkip表示驱动不支持 由database/sql回退到其他方式 不记录为错误
+func finish(op *localtracing.Operation, err error) {
+	if err != nil && !errors.Is(err, driver.ErrSkip) {
+		op.SetError(err)
+	}
+	op.End()
+}
+
+// 语句类型 取第一个关键字
+func verb(query string) string {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return "QUERY"
+	}
+	return strings.ToUpper(strings.TrimLeft(fields[0], "("))
+}
+
+type tracedDriver struct {
+	base driver.Driver
+}
+
+func (d *tracedDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.base.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &tracedConn{base: conn}, nil
+}
+
+func (d *tracedDriver) OpenConnector(name string) (driver.Connector, error) {
+	if dc, ok := d.base.(driver.DriverContext); ok {
+		connector, err := dc.OpenConnector(name)
+		if err != nil {
+			return nil, err
+		}
+		return &tracedConnector{base: connector, driver: d}, nil
+	}
+	return &dsnConnector{name: name, driver: d}, nil
+}
+
+type tracedConnector struct {
+	base   driver.Connector
+	driver *tracedDriver
+}
+
+func (c *tracedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.base.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &tracedConn{base: conn}, nil
+}
+
+func (c *tracedConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+type dsnConnector struct {
+	name   string
+	driver *tracedDriver
+}
+
+func (c *dsnConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.name)
+}
+
+func (c *dsnConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+type tracedConn struct {
+	base driver.Conn
+	tx   *tracedTx // 进行中的事务 database/sql保证同一时间只有一个协程使用连接
+}
+
+// 事务中的调用挂在事务节点下
+func (c *tracedConn) traceCtx(ctx context.Context) context.Context {
+	if c.tx != nil {
+		return c.tx.ctx
+	}
+	return ctx
+}
+
+func (c *tracedConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *tracedConn) PrepareContext(ctx context.Context, query string) (stmt driver.Stmt, err error) {
+	op := start(c.traceCtx(ctx), "PREPARE", query)
+	defer func() { finish(op, err) }()
+
+	if pc, ok := c.base.(driver.ConnPrepareContext); ok {
+		stmt, err = pc.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.base.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &tracedStmt{base: stmt, query: query, conn: c}, nil
+}
+
+func (c *tracedConn) Close() error {
+	return c.base.Close()
+}
+
+func (c *tracedConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+// 事务记录为一个节点 从Begin开始到Commit、Rollback结束
+func (c *tracedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	txCtx, op := localtracing.StartOperation(ctx, "SQL TX")
+
+	var (
+		tx  driver.Tx
+		err error
+	)
+	if bc, ok := c.base.(driver.ConnBeginTx); ok {
+		tx, err = bc.BeginTx(ctx, opts)
+	} else {
+		tx, err = c.base.Begin()
+	}
+	if err != nil {
+		finish(op, err)
+		return nil, err
+	}
+	c.tx = &tracedTx{base: tx, conn: c, ctx: txCtx, op: op}
+	return c.tx, nil
+}
+
+func (c *tracedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	var exec func() (driver.Result, error)
+	if ec, ok := c.base.(driver.ExecerContext); ok {
+		exec = func() (driver.Result, error) { return ec.ExecContext(ctx, query, args) }
+	} else if e, ok := c.base.(driver.Execer); ok {
+		exec = func() (driver.Result, error) {
+			values, err := toValues(args)
+			if err != nil {
+				return nil, err
+			}
+			return e.Exec(query, values)
+		}
+	} else {
+		return nil, driver.ErrSkip
+	}
+
+	op := start(c.traceCtx(ctx), verb(query), query)
+	res, err := exec()
+	recordResult(op, res, err)
+	return res, err
+}
+
+func (c *tracedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	var doQuery func() (driver.Rows, error)
+	if qc, ok := c.base.(driver.QueryerContext); ok {
+		doQuery = func() (driver.Rows, error) { return qc.QueryContext(ctx, query, args) }
+	} else if q, ok := c.base.(driver.Queryer); ok {
+		doQuery = func() (driver.Rows, error) {
+			values, err := toValues(args)
+			if err != nil {
+				return nil, err
+			}
+			return q.Query(query, values)
+		}
+	} else {
+		return nil, driver.ErrSkip
+	}
+
+	op := start(c.traceCtx(ctx), verb(query), query)
+	rows, err := doQuery()
+	if err != nil {
+		finish(op, err)
+		return nil, err
+	}
+	return &tracedRows{base: rows, op: op}, nil
+}
+
+func (c *tracedConn) Ping(ctx context.Context) error {
+	if p, ok := c.base.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *tracedConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.base.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *tracedConn) IsValid() bool {
+	if v, ok := c.base.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+func (c *tracedConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if nc, ok := c.base.(driver.NamedValueChecker); ok {
+		return nc.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+type tracedTx struct {
+	base driver.Tx
+	conn *tracedConn
+	ctx  context.Context // 携带事务节点
+	op   *localtracing.Operation
+}
+
+func (t *tracedTx) Commit() error {
+	return t.end("commit", t.base.Commit())
+}
+
+func (t *tracedTx) Rollback() error {
+	return t.end("rollback", t.base.Rollback())
+}
+
+func (t *tracedTx) end(result string, err error) error {
+	t.conn.tx = nil
+	t.op.SetAttr("db.tx", result)
+	finish(t.op, err)
+	return err
+}
+
+type tracedStmt struct {
+	base  driver.Stmt
+	query string
+	conn  *tracedConn
+}
+
+func (s *tracedStmt) Close() error {
+	return s.base.Close()
+}
+
+func (s *tracedStmt) NumInput() int {
+	return s.base.NumInput()
+}
+
+func (s *tracedStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.ExecContext(context.Background(), toNamed(args))
+}
+
+func (s *tracedStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), toNamed(args))
+}
+
+func (s *tracedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	op := start(s.conn.traceCtx(ctx), verb(s.query), s.query)
+
+	var (
+		res driver.Result
+		err error
+	)
+	if ec, ok := s.base.(driver.StmtExecContext); ok {
+		res, err = ec.ExecContext(ctx, args)
+	} else if values, verr := toValues(args); verr != nil {
+		err = verr
+	} else {
+		res, err = s.base.Exec(values)
+	}
+	recordResult(op, res, err)
+	return res, err
+}
+
+func (s *tracedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	op := start(s.conn.traceCtx(ctx), verb(s.query), s.query)
+
+	var (
+		rows driver.Rows
+		err  error
+	)
+	if qc, ok := s.base.(driver.StmtQueryContext); ok {
+		rows, err = qc.QueryContext(ctx, args)
+	} else if values, verr := toValues(args); verr != nil {
+		err = verr
+	} else {
+		rows, err = s.base.Query(values)
+	}
+	if err != nil {
+		finish(op, err)
+		return nil, err
+	}
+	return &tracedRows{base: rows, op: op}, nil
+}
+
+func (s *tracedStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if nc, ok := s.base.(driver.NamedValueChecker); ok {
+		return nc.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+func recordResult(op *localtracing.Operation, res driver.Result, err error) {
+	if err == nil && res != nil {
+		if n, rerr := res.RowsAffected(); rerr == nil {
+			op.SetAttr("db.rows", n)
+		}
+	}
+	finish(op, err)
+}
+
+// 记录返回的行数 在Close时结束调用
+type tracedRows struct {
+	base  driver.Rows
+	op    *localtracing.Operation
+	count int64
+}
+
+func (r *tracedRows) Columns() []string {
+	return r.base.Columns()
+}
+
+func (r *tracedRows) Close() error {
+	err := r.base.Close()
+	r.op.SetAttr("db.rows", r.count)
+	finish(r.op, err)
+	return err
+}
+
+func (r *tracedRows) Next(dest []driver.Value) error {
+	err := r.base.Next(dest)
+	if err == nil {
+		r.count++
+	} else if err != io.EOF {
+		r.op.SetError(err)
+	}
+	return err
+}
+
+func (r *tracedRows) HasNextResultSet() bool {
+	if rs, ok := r.base.(driver.RowsNextResultSet); ok {
+		return rs.HasNextResultSet()
+	}
+	return false
+}
+
+func (r *tracedRows) NextResultSet() error {
+	if rs, ok := r.base.(driver.RowsNextResultSet); ok {
+		return rs.NextResultSet()
+	}
+	return io.EOF
+}
+
+// 以下为列类型信息 驱动没有实现时返回与database/sql相同的默认值
+
+func (r *tracedRows) ColumnTypeScanType(index int) reflect.Type {
+	if ct, ok := r.base.(driver.RowsColumnTypeScanType); ok {
+		return ct.ColumnTypeScanType(index)
+	}
+	return reflect.TypeOf(new(interface{})).Elem()
+}
+
+func (r *tracedRows) ColumnTypeDatabaseTypeName(index int) string {
+	if ct, ok := r.base.(driver.RowsColumnTypeDatabaseTypeName); ok {
+		return ct.ColumnTypeDatabaseTypeName(index)
+	}
+	return ""
+}
+
+func (r *tracedRows) ColumnTypeLength(index int) (int64, bool) {
+	if ct, ok := r.base.(driver.RowsColumnTypeLength); ok {
+		return ct.ColumnTypeLength(index)
+	}
+	return 0, false
+}
+
+func (r *tracedRows) ColumnTypeNullable(index int) (bool, bool) {
+	if ct, ok := r.base.(driver.RowsColumnTypeNullable); ok {
+		return ct.ColumnTypeNullable(index)
+	}
+	return false, false
+}
+
+func (r *tracedRows) ColumnTypePrecisionScale(index int) (int64, int64, bool) {
+	if ct, ok := r.base.(driver.RowsColumnTypePrecisionScale); ok {
+		return ct.ColumnTypePrecisionScale(index)
+	}
+	return 0, 0, false
+}
+
+func toNamed(args []driver.Value) []driver.NamedValue {
+	res := make([]driver.NamedValue, len(args))
+	for i, val := range args {
+		res[i] = driver.NamedValue{Ordinal: i + 1, Value: val}
+	}
+	return res
+}
+
+func toValues(args []driver.NamedValue) ([]driver.Value, error) {
+	res := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			return nil, errors.New("sqltrace: 驱动不支持命名参数")
+		}
+		res[i] = arg.Value
+	}
+	return res, nil
+}
@@ -0,0 +1,239 @@
+package sqltrace
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/wwqdrh/localtracing"
+)
+
+// 内存中的假驱动 query为fail时返回错误 查询固定返回3行
+type fakeDriver struct{ legacy bool }
+
+func (d fakeDriver) Open(string) (driver.Conn, error) {
+	if d.legacy {
+		return &legacyConn{}, nil
+	}
+	return &fakeConn{}, nil
+}
+
+type legacyConn struct{}
+
+func (c *legacyConn) Prepare(query string) (driver.Stmt, error) {
+	if query == "fail" {
+		return nil, errors.New("prepare failed")
+	}
+	return &fakeStmt{}, nil
+}
+func (c *legacyConn) Close() error              { return nil }
+func (c *legacyConn) Begin() (driver.Tx, error) { return fakeTx{}, nil }
+
+type fakeConn struct{ legacyConn }
+
+func (c *fakeConn) ExecContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Result, error) {
+	if query == "fail" {
+		return nil, errors.New("exec failed")
+	}
+	return driver.RowsAffected(2), nil
+}
+
+func (c *fakeConn) QueryContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	return &fakeRows{n: 3}, nil
+}
+
+type fakeStmt struct{}
+
+func (fakeStmt) Close() error  { return nil }
+func (fakeStmt) NumInput() int { return -1 }
+func (fakeStmt) Exec([]driver.Value) (driver.Result, error) {
+	return driver.RowsAffected(1), nil
+}
+func (fakeStmt) Query([]driver.Value) (driver.Rows, error) {
+	return &fakeRows{n: 3}, nil
+}
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeRows struct{ n int }
+
+func (r *fakeRows) Columns() []string { return []string{"id"} }
+func (r *fakeRows) Close() error      { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.n == 0 {
+		return io.EOF
+	}
+	r.n--
+	dest[0] = int64(r.n)
+	return nil
+}
+
+func init() {
+	sql.Register("fake-trace", Wrap(fakeDriver{}))
+	sql.Register("fake-legacy-trace", Wrap(fakeDriver{legacy: true}))
+}
+
+func queryAll(t *testing.T, ctx context.Context, db *sql.DB) {
+	rows, err := db.QueryContext(ctx, "SELECT id FROM user WHERE name = 'a'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+	}
+	rows.Close()
+}
+
+func TestDriver(t *testing.T) {
+	db, err := sql.Open("fake-trace", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	trace := localtracing.NewTrace("GET /sql")
+	ctx := localtracing.NewContext(context.Background(), trace)
+
+	if _, err := db.ExecContext(ctx, "UPDATE user SET age = 18\n WHERE id IN (1, 2, 3)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, "fail"); err == nil {
+		t.Fatal("应该返回错误")
+	}
+	queryAll(t, ctx, db)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM user WHERE id = 1"); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := tx.QueryContext(ctx, "SELECT id FROM user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows.Close()
+	tx.Commit()
+	// 事务结束后的调用不再挂在事务下
+	queryAll(t, ctx, db)
+
+	spans := trace.Tree().Children
+	names := []string{}
+	for _, item := range spans {
+		names = append(names, item.Name)
+	}
+	want := []string{"SQL UPDATE", "SQL FAIL", "SQL SELECT", "SQL TX", "SQL SELECT"}
+	if len(names) != len(want) {
+		t.Fatalf("记录的节点错误: %v", names)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("记录的节点错误: %v", names)
+		}
+	}
+
+	if spans[0].Attrs["db.statement"] != "UPDATE user SET age = ? WHERE id IN (?)" || spans[0].Attrs["db.rows"] != int64(2) {
+		t.Errorf("exec记录错误: %+v", spans[0].Attrs)
+	}
+	if spans[1].Error == "" {
+		t.Error("没有记录错误")
+	}
+	if spans[2].Attrs["db.statement"] != "SELECT id FROM user WHERE name = ?" || spans[2].Attrs["db.rows"] != int64(3) {
+		t.Errorf("query记录错误: %+v", spans[2].Attrs)
+	}
+
+	// 事务中的调用为事务节点的子节点
+	txSpan := spans[3]
+	if txSpan.Attrs["db.tx"] != "commit" || len(txSpan.Children) != 2 ||
+		txSpan.Children[0].Name != "SQL DELETE" || txSpan.Children[1].Name != "SQL SELECT" {
+		t.Errorf("事务记录错误: %+v", txSpan)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	db, err := sql.Open("fake-trace", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	trace := localtracing.NewTrace("GET /sql")
+	ctx := localtracing.NewContext(context.Background(), trace)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stmt, err := tx.PrepareContext(ctx, "UPDATE user SET age = ?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stmt.ExecContext(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	stmt.Close()
+	tx.Rollback()
+
+	spans := trace.Tree().Children
+	if len(spans) != 1 || spans[0].Name != "SQL TX" || spans[0].Attrs["db.tx"] != "rollback" {
+		t.Fatalf("事务记录错误: %+v", spans)
+	}
+	if children := spans[0].Children; len(children) != 2 || children[0].Name != "SQL PREPARE" || children[1].Name != "SQL UPDATE" {
+		t.Errorf("prepare的语句没有挂在事务下: %+v", children)
+	}
+}
+
+func TestLegacyDriver(t *testing.T) {
+	db, err := sql.Open("fake-legacy-trace", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	trace := localtracing.NewTrace("GET /sql")
+	ctx := localtracing.NewContext(context.Background(), trace)
+
+	// 驱动不支持直接执行时回退为prepare+exec
+	if _, err := db.ExecContext(ctx, "DELETE FROM user WHERE id = ?", 1); err != nil {
+		t.Fatal(err)
+	}
+	queryAll(t, ctx, db)
+
+	spans := trace.Tree().Children
+	if len(spans) != 4 || spans[0].Name != "SQL PREPARE" || spans[1].Name != "SQL DELETE" || spans[3].Name != "SQL SELECT" {
+		t.Fatalf("回退时记录的节点错误: %d", len(spans))
+	}
+	if spans[1].Error != "" || spans[1].Attrs["db.rows"] != int64(1) || spans[3].Attrs["db.rows"] != int64(3) {
+		t.Error("回退时记录的信息错误")
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	for query, want := range map[string]string{
+		"select * from t1 where a = 1.5 and b = 'it''s'": "select * from t1 where a = ? and b = ?",
+		"  insert into t values (1, 'a', 2)  ":           "insert into t values (?)",
+		"select id_2 from t where id in (?, ?, ?)":       "select id_2 from t where id in (?)",
+		"select\n\t*\nfrom t where s = 'a\\'b'":          "select * from t where s = ?",
+		// 占位符保持不变
+		"select * from t where a = $1 and b = $12": "select * from t where a = $1 and b = $12",
+		"select * from t where a = ? and b = 2":    "select * from t where a = ? and b = ?",
+		// 十六进制作为一个常量
+		"select * from t where h = 0x1F":           "select * from t where h = ?",
+		"update t set h = 0XdeadBEEF where id = 3": "update t set h = ? where id = ?",
+		"select * from t where h in (0x1, 0xff)":   "select * from t where h in (?)",
+		// 标准SQL中\不是转义字符
+		"select * from t where p = 'C:\\' and id = 1": "select * from t where p = ? and id = ?",
+		// 双引号为标识符
+		`select "it's", "t2" from t where a = 'b'`: `select "it's", "t2" from t where a = ?`,
+	} {
+		if got := Normalize(query); got != want {
+			t.Errorf("Normalize(%q) = %q, want %q", query, got, want)
+		}
+	}
+}
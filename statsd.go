@@ -0,0 +1,174 @@
+package localtracing
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+////////////////////
+// StatsD/DogStatsD输出 请求以及Time()函数的耗时通过UDP发送到本机的agent
+// 多条指标以换行分隔合并到一个包中 包的大小不超过MTU
+// 队列满或者发送失败时丢弃并计数
+////////////////////
+
+// StatsDConfig StatsD输出配置 零值使用默认配置
+type StatsDConfig struct {
+	Addr          string        // agent地址 默认127.0.0.1:8125
+	Prefix        string        // 指标名前缀 例如myapp.
+	Tags          []string      // 附加在所有指标上的标签 例如env:prod
+	Plain         bool          // 标准StatsD 不支持标签 只发送指标名
+	MaxPacketSize int           // 单个UDP包的最大字节数 默认1432(以太网MTU减去IP/UDP头)
+	QueueSize     int           // 等待发送的最大指标数 默认4096
+	FlushInterval time.Duration // 不足一个包时的发送间隔 默认1s
+}
+
+// StatsDEmitter 发送请求数、请求耗时以及函数耗时
+//
+//	http.request.count    计数 标签route、method、status
+//	http.request.duration 耗时(ms) 标签route、method、status
+//	span.duration         耗时(ms) 标签function
+type StatsDEmitter struct {
+	cfg  StatsDConfig
+	conn net.Conn
+	tags string // 格式化后的公共标签
+
+	queue *asyncQueue
+}
+
+func NewStatsDEmitter(cfg StatsDConfig) (*StatsDEmitter, error) {
+	if cfg.Addr == "" {
+		cfg.Addr = "127.0.0.1:8125"
+	}
+	if cfg.MaxPacketSize <= 0 {
+		cfg.MaxPacketSize = 1432
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 4096
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = time.Second
+	}
+	conn, err := net.Dial("udp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &StatsDEmitter{
+		cfg:   cfg,
+		conn:  conn,
+		queue: newAsyncQueue(cfg.QueueSize),
+	}
+	if len(cfg.Tags) > 0 {
+		tags := make([]string, len(cfg.Tags))
+		for i, tag := range cfg.Tags {
+			tags[i] = sanitizeTag(tag)
+		}
+		e.tags = strings.Join(tags, ",")
+	}
+	go e.run()
+	return e, nil
+}
+
+// Request 记录一次请求
+func (e *StatsDEmitter) Request(method, route string, status int, d time.Duration) {
+	if e == nil {
+		return
+	}
+	tags := []string{"route:" + route, "method:" + method, "status:" + strconv.Itoa(status)}
+	e.emit("http.request.count", "1", "c", tags)
+	e.emit("http.request.duration", formatMs(d), "ms", tags)
+}
+
+// Span 记录一次Time()函数调用
+func (e *StatsDEmitter) Span(name string, d time.Duration) {
+	if e == nil {
+		return
+	}
+	e.emit("span.duration", formatMs(d), "ms", []string{"function:" + name})
+}
+
+// 格式化为一行 name:value|type|#tag1,tag2
+func (e *StatsDEmitter) emit(name, value, typ string, tags []string) {
+	var b strings.Builder
+	b.WriteString(sanitizeName(e.cfg.Prefix + name))
+	b.WriteByte(':')
+	b.WriteString(value)
+	b.WriteByte('|')
+	b.WriteString(typ)
+	if !e.cfg.Plain && (len(tags) > 0 || e.tags != "") {
+		b.WriteString("|#")
+		for i, tag := range tags {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(sanitizeTag(tag))
+		}
+		if e.tags != "" {
+			if len(tags) > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(e.tags)
+		}
+	}
+	// 加入发送队列 队列已满时丢弃
+	e.queue.push(b.String())
+}
+
+// Dropped 被丢弃的指标数
+func (e *StatsDEmitter) Dropped() int64 {
+	return e.queue.droppedCount()
+}
+
+// Shutdown 发送队列中剩余的指标并关闭连接 ctx结束时不再等待
+func (e *StatsDEmitter) Shutdown(ctx context.Context) error {
+	return e.queue.shutdown(ctx)
+}
+
+func (e *StatsDEmitter) run() {
+	defer e.conn.Close()
+
+	buf := make([]byte, 0, e.cfg.MaxPacketSize)
+	lines := 0
+	flush := func() {
+		if len(buf) > 0 {
+			if _, err := e.conn.Write(buf); err != nil {
+				e.queue.drop(lines)
+			}
+			buf, lines = buf[:0], 0
+		}
+	}
+	// 加入当前的包 超过大小时先发送之前的内容 单条超过大小时单独发送
+	add := func(item interface{}) {
+		line := item.(string)
+		if len(buf) > 0 && len(buf)+1+len(line) > e.cfg.MaxPacketSize {
+			flush()
+		}
+		if len(buf) > 0 {
+			buf = append(buf, '\n')
+		}
+		buf = append(buf, line...)
+		lines++
+	}
+	e.queue.run(e.cfg.FlushInterval, add, flush)
+}
+
+func formatMs(d time.Duration) string {
+	return strconv.FormatFloat(durationMs(d), 'f', -1, 64)
+}
+
+// 指标名中不能出现: | @ 以及空白
+var statsdNameReplacer = strings.NewReplacer(":", "_", "|", "_", "@", "_", " ", "_", "\n", "_")
+
+// 标签中不能出现, | 以及空白 第一个:用于分隔标签名与值
+var statsdTagReplacer = strings.NewReplacer(",", "_", "|", "_", " ", "_", "\n", "_")
+
+func sanitizeName(name string) string {
+	return statsdNameReplacer.Replace(name)
+}
+
+func sanitizeTag(tag string) string {
+	return statsdTagReplacer.Replace(tag)
+}
@@ -0,0 +1,129 @@
+package localtracing
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 本地UDP监听 收集收到的包
+func listenUDP(t *testing.T) (*net.UDPConn, chan string) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets := make(chan string, 100)
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				close(packets)
+				return
+			}
+			packets <- string(buf[:n])
+		}
+	}()
+	return conn, packets
+}
+
+func TestStatsDEmitter(t *testing.T) {
+	conn, packets := listenUDP(t)
+	defer conn.Close()
+
+	emitter, err := NewStatsDEmitter(StatsDConfig{
+		Addr:          conn.LocalAddr().String(),
+		Prefix:        "demo.",
+		Tags:          []string{"env:test"},
+		FlushInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler, err := NewLocaltracing("./log", WithStatsD(emitter))
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := handler.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer handler.Time()()
+		CurrentTrace().SetRoute("/user/:id")
+		w.WriteHeader(404)
+	}))
+	app.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/user/1", nil))
+	if err := handler.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var packet string
+	select {
+	case packet = <-packets:
+	case <-time.After(3 * time.Second):
+		t.Fatal("没有收到数据")
+	}
+	// Time()在请求结束前记录
+	lines := strings.Split(packet, "\n")
+	if len(lines) != 3 {
+		t.Fatalf("没有合并为一个包: %q", packet)
+	}
+	if !strings.HasPrefix(lines[0], "demo.span.duration:") ||
+		!strings.HasSuffix(lines[0], "|ms|#function:github.com/wwqdrh/localtracing.TestStatsDEmitter.func1,env:test") {
+		t.Errorf("函数耗时格式错误: %s", lines[0])
+	}
+	if lines[1] != "demo.http.request.count:1|c|#route:/user/:id,method:GET,status:404,env:test" {
+		t.Errorf("请求数格式错误: %s", lines[1])
+	}
+	if !strings.HasPrefix(lines[2], "demo.http.request.duration:") ||
+		!strings.HasSuffix(lines[2], "|ms|#route:/user/:id,method:GET,status:404,env:test") {
+		t.Errorf("请求耗时格式错误: %s", lines[2])
+	}
+}
+
+func TestStatsDBatch(t *testing.T) {
+	conn, packets := listenUDP(t)
+	defer conn.Close()
+
+	emitter, err := NewStatsDEmitter(StatsDConfig{
+		Addr:          conn.LocalAddr().String(),
+		Plain:         true,
+		MaxPacketSize: 100,
+		FlushInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		emitter.Span("handle|user", 1500*time.Microsecond)
+	}
+	if err := emitter.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	count := 0
+	for count < 20 {
+		select {
+		case packet := <-packets:
+			if len(packet) > 100 {
+				t.Errorf("超过包大小: %d", len(packet))
+			}
+			for _, line := range strings.Split(packet, "\n") {
+				if line != "span.duration:1.5|ms" {
+					t.Errorf("格式错误: %s", line)
+				}
+				count++
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("只收到%d条", count)
+		}
+	}
+	if emitter.Dropped() != 0 {
+		t.Errorf("丢弃数错误: %d", emitter.Dropped())
+	}
+	emitter.Span("late", time.Millisecond)
+	if emitter.Dropped() != 1 {
+		t.Error("关闭后应该丢弃")
+	}
+}
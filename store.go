@@ -0,0 +1,208 @@
+package localtracing
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+////////////////////
+// 最近请求的调用树 用于在监控页面查看以及导出
+// 环形缓冲区同时限制条数与估算的内存占用 超出时淘汰最早的记录
+////////////////////
+
+const (
+	defaultTraceStoreSize  = 1000
+	defaultTraceStoreBytes = 32 << 20
+)
+
+type storedTrace struct {
+	rec  *TraceRecord
+	size int64
+}
+
+type traceStore struct {
+	mu       sync.RWMutex
+	records  []storedTrace
+	head     int // 最早的记录
+	count    int
+	bytes    int64
+	maxBytes int64
+	evicted  int64
+}
+
+// size为最多保存的请求数 maxBytes为最大内存占用 小于等于0不限制
+func newTraceStore(size int, maxBytes int64) *traceStore {
+	return &traceStore{records: make([]storedTrace, size), maxBytes: maxBytes}
+}
+
+func (s *traceStore) Add(rec *TraceRecord) {
+	if s == nil || len(s.records) == 0 {
+		return
+	}
+	size := rec.memSize()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.maxBytes > 0 && size > s.maxBytes {
+		s.evicted++
+		return
+	}
+	for s.count == len(s.records) || (s.maxBytes > 0 && s.bytes+size > s.maxBytes) {
+		s.removeOldest()
+	}
+	s.records[(s.head+s.count)%len(s.records)] = storedTrace{rec: rec, size: size}
+	s.count++
+	s.bytes += size
+}
+
+func (s *traceStore) removeOldest() {
+	s.bytes -= s.records[s.head].size
+	s.records[s.head] = storedTrace{}
+	s.head = (s.head + 1) % len(s.records)
+	s.count--
+	s.evicted++
+}
+
+// List 最近的记录 新的在前
+func (s *traceStore) List() []*TraceRecord {
+	return s.Find(nil)
+}
+
+// Find 满足条件的记录 新的在前
+func (s *traceStore) Find(f *TraceFilter) []*TraceRecord {
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	res := make([]*TraceRecord, 0, s.count)
+	for i := s.count - 1; i >= 0; i-- {
+		rec := s.records[(s.head+i)%len(s.records)].rec
+		if f.match(rec) {
+			res = append(res, rec)
+			if f != nil && f.Limit > 0 && len(res) >= f.Limit {
+				break
+			}
+		}
+	}
+	return res
+}
+
+// Get trace id对应的记录 同一个trace可能多次经过本服务
+func (s *traceStore) Get(id TraceID) []*TraceRecord {
+	return s.Find(&TraceFilter{TraceID: id})
+}
+
+// TraceSummary 请求列表中的信息 不包含调用树
+type TraceSummary struct {
+	TraceID  TraceID       `json:"trace_id"`
+	SpanID   SpanID        `json:"span_id"`
+	Method   string        `json:"method"`
+	Route    string        `json:"route"`
+	URL      string        `json:"url"`
+	Status   int           `json:"status"`
+	Panic    bool          `json:"panic,omitempty"`
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+	Spans    int           `json:"spans"` // 节点数
+}
+
+func (r *TraceRecord) Summary() TraceSummary {
+	res := TraceSummary{
+		TraceID:  r.TraceID,
+		Method:   r.Method,
+		Route:    r.Route,
+		URL:      r.URL,
+		Status:   r.Status,
+		Panic:    r.Panic,
+		Start:    r.Start,
+		Duration: r.Duration,
+	}
+	if r.Root != nil {
+		res.SpanID = r.Root.ID
+	}
+	r.walk(func(*Span, SpanID) { res.Spans++ })
+	return res
+}
+
+// TraceStoreStats 调用树缓冲区的使用情况
+type TraceStoreStats struct {
+	Count    int   `json:"count"`
+	Bytes    int64 `json:"bytes"`
+	MaxCount int   `json:"max_count"`
+	MaxBytes int64 `json:"max_bytes"`
+	Evicted  int64 `json:"evicted"` // 被淘汰或者超过内存限制没有保存的请求数
+}
+
+func (s *traceStore) Stats() TraceStoreStats {
+	if s == nil {
+		return TraceStoreStats{}
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return TraceStoreStats{
+		Count:    s.count,
+		Bytes:    s.bytes,
+		MaxCount: len(s.records),
+		MaxBytes: s.maxBytes,
+		Evicted:  s.evicted,
+	}
+}
+
+// TraceFilter 查询条件 零值表示不过滤
+type TraceFilter struct {
+	TraceID     TraceID
+	Route       string // 路由模板 例如/user/:id
+	Method      string
+	Status      int // 精确的状态码
+	StatusClass int // 状态码类别 例如5表示5xx
+	Failed      bool
+	MinDuration time.Duration
+	From, To    time.Time // 请求开始时间的范围
+	Limit       int
+}
+
+func (f *TraceFilter) match(rec *TraceRecord) bool {
+	switch {
+	case f == nil:
+		return true
+	case f.TraceID.IsValid() && rec.TraceID != f.TraceID:
+	case f.Route != "" && rec.Route != f.Route:
+	case f.Method != "" && !strings.EqualFold(rec.Method, f.Method):
+	case f.Status != 0 && rec.Status != f.Status:
+	case f.StatusClass != 0 && rec.Status/100 != f.StatusClass:
+	case f.Failed && !rec.Failed():
+	case rec.Duration < f.MinDuration:
+	case !f.From.IsZero() && rec.Start.Before(f.From):
+	case !f.To.IsZero() && rec.Start.After(f.To):
+	default:
+		return true
+	}
+	return false
+}
+
+////////////////////
+// 内存占用估算 按照结构体大小加上字符串长度粗略计算
+////////////////////
+
+const (
+	recordOverhead = 160
+	spanOverhead   = 160
+	attrOverhead   = 48
+)
+
+func (r *TraceRecord) memSize() int64 {
+	size := int64(recordOverhead + len(r.Method) + len(r.Route) + len(r.URL))
+	r.walk(func(span *Span, _ SpanID) {
+		size += spanOverhead + int64(len(span.Name)+len(span.Error))
+		for key, val := range span.Attrs {
+			size += attrOverhead + int64(len(key))
+			if s, ok := val.(string); ok {
+				size += int64(len(s))
+			}
+		}
+	})
+	return size
+}
@@ -0,0 +1,88 @@
+package localtracing
+
+import (
+	"testing"
+	"time"
+)
+
+func newStoreRecord(route string, status int, d time.Duration) *TraceRecord {
+	return &TraceRecord{
+		TraceID:  newTraceID(),
+		Method:   "GET",
+		Route:    route,
+		URL:      route,
+		Status:   status,
+		Start:    time.Now(),
+		Duration: d,
+		Root:     &Span{ID: newSpanID(), Name: "GET " + route, Count: 1},
+	}
+}
+
+func TestTraceStoreRing(t *testing.T) {
+	store := newTraceStore(3, 0)
+	recs := []*TraceRecord{}
+	for i := 0; i < 5; i++ {
+		rec := newStoreRecord("/a", 200, 0)
+		recs = append(recs, rec)
+		store.Add(rec)
+	}
+
+	list := store.List()
+	if len(list) != 3 || list[0] != recs[4] || list[2] != recs[2] {
+		t.Fatal("环形缓冲区顺序错误")
+	}
+	if len(store.Get(recs[1].TraceID)) != 0 || len(store.Get(recs[3].TraceID)) != 1 {
+		t.Error("查询trace id错误")
+	}
+	if stats := store.Stats(); stats.Count != 3 || stats.Evicted != 2 {
+		t.Errorf("统计错误: %+v", stats)
+	}
+}
+
+func TestTraceStoreMemoryLimit(t *testing.T) {
+	size := newStoreRecord("/a", 200, 0).memSize()
+	store := newTraceStore(100, size*2)
+	for i := 0; i < 5; i++ {
+		store.Add(newStoreRecord("/a", 200, 0))
+	}
+	if stats := store.Stats(); stats.Count != 2 || stats.Bytes > size*2 || stats.Evicted != 3 {
+		t.Errorf("内存限制错误: %+v", stats)
+	}
+
+	// 单个请求超过限制时不保存
+	big := newStoreRecord("/a", 200, 0)
+	big.Root.Attrs = map[string]interface{}{"body": string(make([]byte, size*2))}
+	store.Add(big)
+	if len(store.Get(big.TraceID)) != 0 || store.Stats().Count != 2 {
+		t.Error("超过限制的请求不应该保存")
+	}
+}
+
+func TestTraceFilter(t *testing.T) {
+	store := newTraceStore(10, 0)
+	store.Add(newStoreRecord("/a", 200, 10*time.Millisecond))
+	store.Add(newStoreRecord("/a", 503, 200*time.Millisecond))
+	store.Add(newStoreRecord("/b", 404, 300*time.Millisecond))
+	panicked := newStoreRecord("/b", 200, 0)
+	panicked.Panic = true
+	store.Add(panicked)
+
+	for name, item := range map[string]struct {
+		filter TraceFilter
+		count  int
+	}{
+		"route":    {TraceFilter{Route: "/a"}, 2},
+		"status":   {TraceFilter{Status: 404}, 1},
+		"class":    {TraceFilter{StatusClass: 2}, 2},
+		"failed":   {TraceFilter{Failed: true}, 2},
+		"duration": {TraceFilter{MinDuration: 100 * time.Millisecond}, 2},
+		"combined": {TraceFilter{Route: "/a", MinDuration: 100 * time.Millisecond}, 1},
+		"from":     {TraceFilter{From: time.Now().Add(time.Minute)}, 0},
+		"to":       {TraceFilter{To: time.Now().Add(-time.Minute)}, 0},
+		"limit":    {TraceFilter{Limit: 3}, 3},
+	} {
+		if res := store.Find(&item.filter); len(res) != item.count {
+			t.Errorf("%s: 数量错误 %d", name, len(res))
+		}
+	}
+}
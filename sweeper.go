@@ -0,0 +1,112 @@
+package localtracing
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+////////////////////
+// 协程上下文的泄漏保护
+// 没有调用ClearContext的协程(请求之外使用SetContextValue、Time)会一直占用goroutineLocal
+// 后台定期清理超过存活时间的上下文，并限制上下文总数
+////////////////////
+
+var (
+	contextMaxAge  int64 = int64(10 * time.Minute) // 上下文最长存活时间 需要大于最长的请求耗时
+	contextMaxSize int64 = 100000                  // 上下文最大数量
+
+	sweepInterval = 30 * time.Second
+
+	localStats  = struct{ live, evicted int64 }{}
+	sweeperOnce sync.Once
+	sweepSignal = make(chan struct{}, 1)
+)
+
+// ContextStat 协程上下文的统计
+type ContextStat struct {
+	Live    int64 `json:"live"`    // 当前存活的上下文数量
+	Evicted int64 `json:"evicted"` // 被清理的上下文数量
+}
+
+// SetContextLimit 设置协程上下文的最长存活时间以及最大数量 小于等于0表示不限制
+func SetContextLimit(maxAge time.Duration, maxSize int) {
+	atomic.StoreInt64(&contextMaxAge, int64(maxAge))
+	atomic.StoreInt64(&contextMaxSize, int64(maxSize))
+}
+
+// ContextStats 获取协程上下文的统计
+func ContextStats() ContextStat {
+	return ContextStat{
+		Live:    atomic.LoadInt64(&localStats.live),
+		Evicted: atomic.LoadInt64(&localStats.evicted),
+	}
+}
+
+func startSweeper() {
+	sweeperOnce.Do(func() {
+		go func() {
+			ticker := time.NewTicker(sweepInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+				case <-sweepSignal:
+				}
+				sweepContext(time.Now())
+			}
+		}()
+	})
+
+	if max := atomic.LoadInt64(&contextMaxSize); max > 0 && atomic.LoadInt64(&localStats.live) > max {
+		select {
+		case sweepSignal <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// 清理过期的上下文 数量超过限制时从最早创建的开始清理
+func sweepContext(now time.Time) {
+	maxAge := time.Duration(atomic.LoadInt64(&contextMaxAge))
+	maxSize := atomic.LoadInt64(&contextMaxSize)
+
+	type item struct {
+		id      uint64
+		created time.Time
+	}
+	alive := []item{}
+	goroutineLocal.Range(func(key, value interface{}) bool {
+		id, entry := key.(uint64), value.(*localEntry)
+		if maxAge > 0 && now.Sub(entry.created) > maxAge {
+			evictContext(id, entry)
+		} else {
+			alive = append(alive, item{id: id, created: entry.created})
+		}
+		return true
+	})
+
+	if maxSize <= 0 || int64(len(alive)) <= maxSize {
+		return
+	}
+	sort.Slice(alive, func(i, j int) bool {
+		return alive[i].created.Before(alive[j].created)
+	})
+	for _, cur := range alive[:int64(len(alive))-maxSize] {
+		if val, ok := goroutineLocal.Load(cur.id); ok {
+			evictContext(cur.id, val.(*localEntry))
+		}
+	}
+}
+
+func evictContext(id uint64, entry *localEntry) {
+	// 只删除扫描到的那一份 尽量避免误删协程刚刚重新写入的上下文
+	if val, ok := goroutineLocal.Load(id); !ok || val.(*localEntry) != entry {
+		return
+	}
+	if _, loaded := goroutineLocal.LoadAndDelete(id); loaded {
+		atomic.AddInt64(&localStats.live, -1)
+		atomic.AddInt64(&localStats.evicted, 1)
+	}
+}
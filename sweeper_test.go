@@ -0,0 +1,65 @@
+package localtracing
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// 在n个协程中写入上下文但不清理
+func leakContext(n int) {
+	wait := sync.WaitGroup{}
+	wait.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wait.Done()
+			SetContextValue("key", "value")
+		}()
+	}
+	wait.Wait()
+}
+
+func TestSweepContextByAge(t *testing.T) {
+	before := ContextStats()
+	leakContext(5)
+	if stat := ContextStats(); stat.Live-before.Live != 5 {
+		t.Errorf("存活上下文数量错误: %+v", stat)
+	}
+
+	sweepContext(time.Now().Add(time.Hour))
+	stat := ContextStats()
+	if stat.Live != 0 {
+		t.Errorf("过期上下文没有清理: %+v", stat)
+	}
+	if stat.Evicted-before.Evicted < 5 {
+		t.Errorf("清理数量错误: %+v", stat)
+	}
+}
+
+func TestSweepContextBySize(t *testing.T) {
+	SetContextLimit(time.Hour, 3)
+	defer SetContextLimit(10*time.Minute, 100000)
+
+	sweepContext(time.Now().Add(2 * time.Hour))
+	leakContext(5)
+	sweepContext(time.Now())
+	if stat := ContextStats(); stat.Live != 3 {
+		t.Errorf("超过数量限制的上下文没有清理: %+v", stat)
+	}
+	sweepContext(time.Now().Add(2 * time.Hour))
+}
+
+func TestClearContextStats(t *testing.T) {
+	wait := sync.WaitGroup{}
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		before := ContextStats()
+		SetContextValue("key", "value")
+		ClearContext()
+		if stat := ContextStats(); stat.Live != before.Live || stat.Evicted != before.Evicted {
+			t.Errorf("ClearContext后统计错误: %+v", stat)
+		}
+	}()
+	wait.Wait()
+}
@@ -0,0 +1,357 @@
+package localtracing
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+////////////////////
+// 调用树的导出格式 Zipkin v2 JSON、Jaeger JSON以及Chrome Trace Event
+// 生成的文件可以直接导入Zipkin、Jaeger的UI或者chrome://tracing、Perfetto中查看
+////////////////////
+
+// ExportFormat 导出格式
+type ExportFormat string
+
+const (
+	FormatZipkin ExportFormat = "zipkin"
+	FormatJaeger ExportFormat = "jaeger"
+	FormatChrome ExportFormat = "chrome"
+)
+
+// ParseExportFormat 解析导出格式 为空时使用zipkin
+func ParseExportFormat(val string) (ExportFormat, error) {
+	switch format := ExportFormat(val); format {
+	case "":
+		return FormatZipkin, nil
+	case FormatZipkin, FormatJaeger, FormatChrome:
+		return format, nil
+	default:
+		return "", fmt.Errorf("不支持的导出格式: %s", val)
+	}
+}
+
+// WriteTraces 以指定格式写入调用树
+func WriteTraces(w io.Writer, format ExportFormat, service string, recs []*TraceRecord) error {
+	var data interface{}
+	switch format {
+	case FormatZipkin:
+		data = zipkinSpans(service, recs)
+	case FormatJaeger:
+		data = jaegerTraces(service, recs)
+	case FormatChrome:
+		data = chromeTrace(recs)
+	default:
+		return fmt.Errorf("不支持的导出格式: %s", format)
+	}
+	return json.NewEncoder(w).Encode(data)
+}
+
+// 遍历请求的调用树 根节点的父节点为上游服务的span id
+func (r *TraceRecord) walk(fn func(span *Span, parent SpanID)) {
+	var visit func(span *Span, parent SpanID)
+	visit = func(span *Span, parent SpanID) {
+		fn(span, parent)
+		for _, child := range span.Children {
+			visit(child, span.ID)
+		}
+	}
+	if r.Root != nil {
+		visit(r.Root, r.ParentID)
+	}
+}
+
+type spanTag struct {
+	key string
+	val interface{}
+}
+
+// 节点的附加信息 按key排序 根节点加上请求的信息
+func (r *TraceRecord) tags(span *Span) []spanTag {
+	keys := make([]string, 0, len(span.Attrs))
+	for key := range span.Attrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	res := make([]spanTag, 0, len(keys)+6)
+	for _, key := range keys {
+		res = append(res, spanTag{key, span.Attrs[key]})
+	}
+	if span.Count > 1 {
+		res = append(res, spanTag{"localtracing.count", int64(span.Count)})
+	}
+	if span.Track > 0 {
+		res = append(res, spanTag{"localtracing.track", int64(span.Track)})
+	}
+	if span == r.Root {
+		res = append(res,
+			spanTag{"http.method", r.Method},
+			spanTag{"http.route", r.Route},
+			spanTag{"http.target", r.URL},
+			spanTag{"http.status_code", int64(r.Status)},
+		)
+	}
+	return res
+}
+
+// 节点的错误信息 根节点在请求失败时也视为错误
+func (r *TraceRecord) spanError(span *Span) (string, bool) {
+	if span.Error != "" {
+		return span.Error, true
+	}
+	if span == r.Root && r.Failed() {
+		if r.Panic {
+			return "panic", true
+		}
+		return strconv.Itoa(r.Status), true
+	}
+	return "", false
+}
+
+// 节点的开始时间与耗时 单位微秒
+func (r *TraceRecord) spanMicros(span *Span) (int64, int64) {
+	start := r.Start.Add(span.Start).UnixNano() / 1000
+	return start, int64(span.Duration) / 1000
+}
+
+////////////////////
+// Zipkin v2 https://zipkin.io/zipkin-api/#/default/post_spans
+////////////////////
+
+type zipkinSpan struct {
+	TraceID       string            `json:"traceId"`
+	ID            string            `json:"id"`
+	ParentID      string            `json:"parentId,omitempty"`
+	Name          string            `json:"name"`
+	Kind          string            `json:"kind,omitempty"`
+	Timestamp     int64             `json:"timestamp"`
+	Duration      int64             `json:"duration,omitempty"`
+	LocalEndpoint zipkinEndpoint    `json:"localEndpoint"`
+	Tags          map[string]string `json:"tags,omitempty"`
+}
+
+type zipkinEndpoint struct {
+	ServiceName string `json:"serviceName"`
+}
+
+func zipkinSpans(service string, recs []*TraceRecord) []zipkinSpan {
+	res := []zipkinSpan{}
+	for _, rec := range recs {
+		rec.walk(func(span *Span, parent SpanID) {
+			start, duration := rec.spanMicros(span)
+			item := zipkinSpan{
+				TraceID:       rec.TraceID.String(),
+				ID:            span.ID.String(),
+				Name:          span.Name,
+				Timestamp:     start,
+				Duration:      duration,
+				LocalEndpoint: zipkinEndpoint{ServiceName: service},
+				Tags:          map[string]string{},
+			}
+			if parent.IsValid() {
+				item.ParentID = parent.String()
+			}
+			if span == rec.Root {
+				item.Kind = "SERVER"
+			}
+			for _, tag := range rec.tags(span) {
+				item.Tags[tag.key] = fmt.Sprint(tag.val)
+			}
+			if msg, ok := rec.spanError(span); ok {
+				item.Tags["error"] = msg
+			}
+			res = append(res, item)
+		})
+	}
+	return res
+}
+
+////////////////////
+// Jaeger 与jaeger-query接口返回的格式一致 可以在Jaeger UI中通过JSON File导入
+////////////////////
+
+type jaegerResponse struct {
+	Data []jaegerTrace `json:"data"`
+}
+
+type jaegerTrace struct {
+	TraceID   string                   `json:"traceID"`
+	Spans     []jaegerSpan             `json:"spans"`
+	Processes map[string]jaegerProcess `json:"processes"`
+}
+
+type jaegerProcess struct {
+	ServiceName string      `json:"serviceName"`
+	Tags        []jaegerTag `json:"tags"`
+}
+
+type jaegerSpan struct {
+	TraceID       string            `json:"traceID"`
+	SpanID        string            `json:"spanID"`
+	OperationName string            `json:"operationName"`
+	References    []jaegerReference `json:"references"`
+	Flags         int               `json:"flags"`
+	StartTime     int64             `json:"startTime"`
+	Duration      int64             `json:"duration"`
+	Tags          []jaegerTag       `json:"tags"`
+	Logs          []interface{}     `json:"logs"`
+	ProcessID     string            `json:"processID"`
+}
+
+type jaegerReference struct {
+	RefType string `json:"refType"`
+	TraceID string `json:"traceID"`
+	SpanID  string `json:"spanID"`
+}
+
+type jaegerTag struct {
+	Key   string      `json:"key"`
+	Type  string      `json:"type"`
+	Value interface{} `json:"value"`
+}
+
+func jaegerTagOf(key string, val interface{}) jaegerTag {
+	switch v := val.(type) {
+	case string:
+		return jaegerTag{key, "string", v}
+	case bool:
+		return jaegerTag{key, "bool", v}
+	case int, int32, int64, uint32:
+		return jaegerTag{key, "int64", v}
+	case float32, float64:
+		return jaegerTag{key, "float64", v}
+	default:
+		return jaegerTag{key, "string", fmt.Sprint(v)}
+	}
+}
+
+// 相同trace id的请求合并为一个trace
+func jaegerTraces(service string, recs []*TraceRecord) *jaegerResponse {
+	const processID = "p1"
+
+	res := &jaegerResponse{Data: []jaegerTrace{}}
+	index := map[TraceID]int{}
+	for _, rec := range recs {
+		i, ok := index[rec.TraceID]
+		if !ok {
+			i = len(res.Data)
+			index[rec.TraceID] = i
+			res.Data = append(res.Data, jaegerTrace{
+				TraceID:   rec.TraceID.String(),
+				Spans:     []jaegerSpan{},
+				Processes: map[string]jaegerProcess{processID: {ServiceName: service, Tags: []jaegerTag{}}},
+			})
+		}
+
+		trace := &res.Data[i]
+		rec.walk(func(span *Span, parent SpanID) {
+			start, duration := rec.spanMicros(span)
+			item := jaegerSpan{
+				TraceID:       rec.TraceID.String(),
+				SpanID:        span.ID.String(),
+				OperationName: span.Name,
+				References:    []jaegerReference{},
+				Flags:         flagSampled,
+				StartTime:     start,
+				Duration:      duration,
+				Tags:          []jaegerTag{},
+				Logs:          []interface{}{},
+				ProcessID:     processID,
+			}
+			if parent.IsValid() {
+				item.References = append(item.References, jaegerReference{"CHILD_OF", rec.TraceID.String(), parent.String()})
+			}
+			if span == rec.Root {
+				item.Tags = append(item.Tags, jaegerTag{"span.kind", "string", "server"})
+			}
+			for _, tag := range rec.tags(span) {
+				item.Tags = append(item.Tags, jaegerTagOf(tag.key, tag.val))
+			}
+			if msg, ok := rec.spanError(span); ok {
+				item.Tags = append(item.Tags, jaegerTag{"error", "bool", true}, jaegerTag{"error.message", "string", msg})
+			}
+			trace.Spans = append(trace.Spans, item)
+		})
+	}
+	return res
+}
+
+////////////////////
+// Chrome Trace Event https://docs.google.com/document/d/1CvAClvFfyA5R-PhYUmn5OOQtYMH4h6I0nSsKchNAySU
+// 每个请求为一个进程 每个节点为一个X事件 子协程为单独的线程
+////////////////////
+
+type chromeTraceFile struct {
+	TraceEvents     []chromeEvent `json:"traceEvents"`
+	DisplayTimeUnit string        `json:"displayTimeUnit"`
+}
+
+type chromeEvent struct {
+	Name string                 `json:"name"`
+	Cat  string                 `json:"cat,omitempty"`
+	Ph   string                 `json:"ph"`
+	Ts   float64                `json:"ts"`
+	Dur  float64                `json:"dur,omitempty"`
+	Pid  int                    `json:"pid"`
+	Tid  int                    `json:"tid"`
+	Args map[string]interface{} `json:"args,omitempty"`
+}
+
+func chromeTrace(recs []*TraceRecord) *chromeTraceFile {
+	res := &chromeTraceFile{TraceEvents: []chromeEvent{}, DisplayTimeUnit: "ms"}
+	for i, rec := range recs {
+		pid := i + 1
+		res.TraceEvents = append(res.TraceEvents, chromeEvent{
+			Name: "process_name", Ph: "M", Pid: pid,
+			Args: map[string]interface{}{"name": rec.Method + " " + rec.URL},
+		})
+
+		tracks := map[int]bool{}
+		rec.walk(func(span *Span, parent SpanID) {
+			if !tracks[span.Track] {
+				tracks[span.Track] = true
+				name := "request"
+				if span.Track > 0 {
+					name = "goroutine " + strconv.Itoa(span.Track)
+				}
+				res.TraceEvents = append(res.TraceEvents, chromeEvent{
+					Name: "thread_name", Ph: "M", Pid: pid, Tid: span.Track,
+					Args: map[string]interface{}{"name": name},
+				})
+			}
+
+			args := map[string]interface{}{"span_id": span.ID.String(), "count": span.Count}
+			for _, tag := range rec.tags(span) {
+				args[tag.key] = tag.val
+			}
+			if msg, ok := rec.spanError(span); ok {
+				args["error"] = msg
+			}
+			if span == rec.Root {
+				args["trace_id"] = rec.TraceID.String()
+			}
+			res.TraceEvents = append(res.TraceEvents, chromeEvent{
+				Name: span.Name,
+				Cat:  "span",
+				Ph:   "X",
+				Ts:   chromeMicros(rec.Start.Add(span.Start)),
+				Dur:  float64(span.Duration) / 1000,
+				Pid:  pid,
+				Tid:  span.Track,
+				Args: args,
+			})
+		})
+	}
+	return res
+}
+
+// 微秒时间戳 整数部分与小数部分分开计算避免丢失精度
+func chromeMicros(t time.Time) float64 {
+	ns := t.UnixNano()
+	return float64(ns/1000) + float64(ns%1000)/1000
+}
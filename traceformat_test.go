@@ -0,0 +1,206 @@
+package localtracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestRecord() *TraceRecord {
+	root := &Span{ID: newSpanID(), Name: "GET /user/1", Duration: 30 * time.Millisecond, Count: 1}
+	child := &Span{ID: newSpanID(), Name: "main.getUser", Start: time.Millisecond, Duration: 20 * time.Millisecond, Count: 2, parent: root}
+	query := &Span{
+		ID: newSpanID(), Name: "SQL SELECT", Start: 2 * time.Millisecond, Duration: 5 * time.Millisecond, Count: 1, Track: 1,
+		Attrs: map[string]interface{}{"db.statement": "select * from user where id = ?", "db.rows": int64(1)},
+		Error: "timeout", parent: child,
+	}
+	root.Children = []*Span{child}
+	child.Children = []*Span{query}
+
+	traceID, parentID, _, _ := ParseTraceparent("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	return &TraceRecord{
+		TraceID:  traceID,
+		ParentID: parentID,
+		Method:   "GET",
+		Route:    "/user/:id",
+		URL:      "/user/1",
+		Status:   500,
+		Start:    time.Unix(1650000000, 0),
+		Duration: 30 * time.Millisecond,
+		Root:     root,
+	}
+}
+
+func TestZipkinFormat(t *testing.T) {
+	rec := newTestRecord()
+	buf := &bytes.Buffer{}
+	if err := WriteTraces(buf, FormatZipkin, "demo", []*TraceRecord{rec}); err != nil {
+		t.Fatal(err)
+	}
+	spans := []zipkinSpan{}
+	if err := json.Unmarshal(buf.Bytes(), &spans); err != nil {
+		t.Fatal(err)
+	}
+	if len(spans) != 3 {
+		t.Fatalf("span数量错误: %d", len(spans))
+	}
+	root, child, query := spans[0], spans[1], spans[2]
+	if root.TraceID != "0af7651916cd43dd8448eb211c80319c" || root.ParentID != "b7ad6b7169203331" || root.Kind != "SERVER" ||
+		root.Timestamp != 1650000000000000 || root.Duration != 30000 || root.LocalEndpoint.ServiceName != "demo" {
+		t.Errorf("根节点错误: %+v", root)
+	}
+	if root.Tags["http.route"] != "/user/:id" || root.Tags["http.status_code"] != "500" || root.Tags["error"] != "500" {
+		t.Errorf("根节点tag错误: %v", root.Tags)
+	}
+	if child.ParentID != root.ID || child.Timestamp != 1650000000001000 || child.Tags["localtracing.count"] != "2" {
+		t.Errorf("子节点错误: %+v", child)
+	}
+	if query.ParentID != child.ID || query.Tags["db.rows"] != "1" || query.Tags["error"] != "timeout" {
+		t.Errorf("查询节点错误: %+v", query)
+	}
+}
+
+func TestJaegerFormat(t *testing.T) {
+	rec, other := newTestRecord(), newTestRecord()
+	other.Root.ID = newSpanID()
+	buf := &bytes.Buffer{}
+	if err := WriteTraces(buf, FormatJaeger, "demo", []*TraceRecord{rec, other}); err != nil {
+		t.Fatal(err)
+	}
+	res := &jaegerResponse{}
+	if err := json.Unmarshal(buf.Bytes(), res); err != nil {
+		t.Fatal(err)
+	}
+	// 相同trace id合并
+	if len(res.Data) != 1 || len(res.Data[0].Spans) != 6 || res.Data[0].Processes["p1"].ServiceName != "demo" {
+		t.Fatalf("trace错误: %+v", res.Data)
+	}
+	root, query := res.Data[0].Spans[0], res.Data[0].Spans[2]
+	if root.StartTime != 1650000000000000 || len(root.References) != 1 || root.References[0].SpanID != "b7ad6b7169203331" {
+		t.Errorf("根节点错误: %+v", root)
+	}
+	tags := map[string]interface{}{}
+	for _, tag := range query.Tags {
+		tags[tag.Key] = tag.Value
+	}
+	if query.References[0].SpanID != res.Data[0].Spans[1].SpanID || tags["error"] != true || tags["db.rows"] != float64(1) {
+		t.Errorf("查询节点错误: %+v", query)
+	}
+
+	if _, err := ParseExportFormat("xml"); err == nil {
+		t.Error("应该返回不支持的格式")
+	}
+}
+
+func TestChromeFormat(t *testing.T) {
+	rec := newTestRecord()
+	buf := &bytes.Buffer{}
+	if err := WriteTraces(buf, FormatChrome, "demo", []*TraceRecord{rec}); err != nil {
+		t.Fatal(err)
+	}
+	res := &chromeTraceFile{}
+	if err := json.Unmarshal(buf.Bytes(), res); err != nil {
+		t.Fatal(err)
+	}
+
+	events := map[string]chromeEvent{}
+	threads := map[int]string{}
+	for _, item := range res.TraceEvents {
+		switch item.Ph {
+		case "X":
+			events[item.Name] = item
+		case "M":
+			if item.Name == "thread_name" {
+				threads[item.Tid] = item.Args["name"].(string)
+			}
+		}
+	}
+	if len(events) != 3 || threads[0] != "request" || threads[1] != "goroutine 1" {
+		t.Fatalf("事件错误: %s", buf.String())
+	}
+	root, query := events["GET /user/1"], events["SQL SELECT"]
+	if root.Ts != 1650000000000000 || root.Dur != 30000 || root.Args["trace_id"] != "0af7651916cd43dd8448eb211c80319c" {
+		t.Errorf("根节点错误: %+v", root)
+	}
+	if query.Ts != 1650000000002000 || query.Tid != 1 || query.Args["db.statement"] != "select * from user where id = ?" || query.Args["error"] != "timeout" {
+		t.Errorf("查询节点错误: %+v", query)
+	}
+}
+
+func TestFileExporter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "traces")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	exporter, err := NewFileExporter(FileExporterConfig{Dir: dir, Format: FormatJaeger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := newTestRecord()
+	exporter.Export(rec)
+	if err := exporter.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := ioutil.ReadFile(filepath.Join(dir, rec.TraceID.String()+"-"+rec.Root.ID.String()+".jaeger.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := &jaegerResponse{}
+	if err := json.Unmarshal(body, res); err != nil || len(res.Data) != 1 || len(res.Data[0].Spans) != 3 {
+		t.Errorf("文件内容错误: %s", body)
+	}
+	if exporter.Dropped() != 0 {
+		t.Error("不应该丢弃数据")
+	}
+}
+
+func TestFileExporterRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "traces")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 之前写入的过期文件在启动时删除
+	old := filepath.Join(dir, "old.zipkin.json")
+	if err := ioutil.WriteFile(old, []byte("[]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(old, past, past)
+
+	exporter, err := NewFileExporter(FileExporterConfig{Dir: dir, MaxFiles: 2, MaxAge: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Error("过期的文件没有删除")
+	}
+
+	recs := []*TraceRecord{newTestRecord(), newTestRecord(), newTestRecord()}
+	for _, rec := range recs {
+		exporter.Export(rec)
+	}
+	if err := exporter.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 {
+		t.Fatalf("保留的文件数错误: %d", len(infos))
+	}
+	if _, err := os.Stat(filepath.Join(dir, recs[0].TraceID.String()+"-"+recs[0].Root.ID.String()+".zipkin.json")); !os.IsNotExist(err) {
+		t.Error("最旧的文件没有删除")
+	}
+}
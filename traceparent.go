@@ -0,0 +1,194 @@
+package localtracing
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+////////////////////
+// W3C Trace Context 传播
+// https://www.w3.org/TR/trace-context/
+// 请求进入时读取traceparent/tracestate，没有则生成新的trace id
+// 出站请求通过InjectHeaders携带当前的trace id与span id
+////////////////////
+
+const (
+	TraceparentHeader   = "traceparent"
+	TracestateHeader    = "tracestate"
+	TraceresponseHeader = "traceresponse" // 响应中返回本服务的trace id与span id
+
+	traceparentVersion = "00"
+	flagSampled        = 0x01
+)
+
+type (
+	TraceID [16]byte
+	SpanID  [8]byte
+)
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (t TraceID) IsValid() bool  { return t != TraceID{} }
+
+func (t TraceID) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+func (s SpanID) String() string { return hex.EncodeToString(s[:]) }
+func (s SpanID) IsValid() bool  { return s != SpanID{} }
+
+func (s SpanID) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (t *TraceID) UnmarshalText(b []byte) error {
+	return decodeHex(t[:], string(b))
+}
+
+func (s *SpanID) UnmarshalText(b []byte) error {
+	return decodeHex(s[:], string(b))
+}
+
+var idGenerator = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(seed()))}
+
+func seed() int64 {
+	var b [8]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		return rand.Int63()
+	}
+	return int64(binary.LittleEndian.Uint64(b[:]))
+}
+
+func newTraceID() (id TraceID) {
+	idGenerator.Lock()
+	defer idGenerator.Unlock()
+	for !id.IsValid() {
+		idGenerator.Read(id[:])
+	}
+	return id
+}
+
+func newSpanID() (id SpanID) {
+	idGenerator.Lock()
+	defer idGenerator.Unlock()
+	for !id.IsValid() {
+		idGenerator.Read(id[:])
+	}
+	return id
+}
+
+// ParseTraceparent 解析traceparent 返回trace id、父节点span id以及flags
+func ParseTraceparent(val string) (TraceID, SpanID, byte, error) {
+	var (
+		traceID TraceID
+		spanID  SpanID
+		flags   [1]byte
+	)
+	parts := strings.Split(strings.TrimSpace(val), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return traceID, spanID, 0, errors.New("traceparent格式错误")
+	}
+	// 版本00只能有4段 更高版本允许在后面追加字段
+	if parts[0] == traceparentVersion && len(parts) != 4 {
+		return traceID, spanID, 0, errors.New("traceparent格式错误")
+	}
+	if _, err := hex.DecodeString(parts[0]); err != nil {
+		return traceID, spanID, 0, errors.New("traceparent版本错误")
+	}
+	if err := decodeHex(traceID[:], parts[1]); err != nil || !traceID.IsValid() {
+		return traceID, spanID, 0, errors.New("traceparent trace-id错误")
+	}
+	if err := decodeHex(spanID[:], parts[2]); err != nil || !spanID.IsValid() {
+		return traceID, spanID, 0, errors.New("traceparent parent-id错误")
+	}
+	if err := decodeHex(flags[:], parts[3]); err != nil {
+		return traceID, spanID, 0, errors.New("traceparent trace-flags错误")
+	}
+	return traceID, spanID, flags[0], nil
+}
+
+// ParseTraceID 解析32位十六进制的trace id
+func ParseTraceID(val string) (TraceID, error) {
+	var id TraceID
+	if err := decodeHex(id[:], val); err != nil || !id.IsValid() {
+		return id, errors.New("trace id格式错误")
+	}
+	return id, nil
+}
+
+// 只接受小写的十六进制
+func decodeHex(dst []byte, src string) error {
+	if len(src) != hex.EncodedLen(len(dst)) || strings.ToLower(src) != src {
+		return errors.New("长度或大小写错误")
+	}
+	_, err := hex.Decode(dst, []byte(src))
+	return err
+}
+
+func formatTraceparent(traceID TraceID, spanID SpanID, flags byte) string {
+	return traceparentVersion + "-" + traceID.String() + "-" + spanID.String() + "-" + hex.EncodeToString([]byte{flags})
+}
+
+// 从请求头中读取上游的调用信息 没有或者格式错误时生成新的trace id
+func (t *Trace) extract(h http.Header) {
+	traceID, parentID, flags, err := ParseTraceparent(h.Get(TraceparentHeader))
+	if err != nil {
+		traceID, parentID, flags = newTraceID(), SpanID{}, flagSampled
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.traceID = traceID
+	t.parentID = parentID
+	t.flags = flags
+	if err == nil {
+		t.traceState = h.Get(TracestateHeader)
+	}
+}
+
+// 设置请求头 span为出站请求的父节点
+func (t *Trace) inject(span *Span, h http.Header) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if span == nil {
+		span = t.current
+	}
+	h.Set(TraceparentHeader, formatTraceparent(t.traceID, span.ID, t.flags))
+	if t.traceState != "" {
+		h.Set(TracestateHeader, t.traceState)
+	}
+}
+
+// TraceID 请求的trace id 与上游服务一致
+func (t *Trace) TraceID() TraceID {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.traceID
+}
+
+// SpanID 本服务处理该请求的span id(根节点)
+func (t *Trace) SpanID() SpanID {
+	return t.root.ID
+}
+
+// ParentSpanID 上游服务的span id 请求没有携带traceparent时为空
+func (t *Trace) ParentSpanID() SpanID {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.parentID
+}
+
+// Traceparent 本服务的traceparent 用于响应头
+func (t *Trace) Traceparent() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return formatTraceparent(t.traceID, t.root.ID, t.flags)
+}
@@ -0,0 +1,93 @@
+package localtracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	traceID, spanID, flags, err := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if traceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || spanID.String() != "00f067aa0ba902b7" || flags != 1 {
+		t.Error("解析结果错误")
+	}
+
+	for _, val := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		if _, _, _, err := ParseTraceparent(val); err == nil {
+			t.Errorf("%q 应该解析失败", val)
+		}
+	}
+
+	// 更高的版本允许追加字段
+	if _, _, _, err := ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMiddlewareTraceparent(t *testing.T) {
+	handler := &LocalTracing{Logger: zap.NewNop(), latency: newLatencyStats()}
+
+	var outgoing http.Header
+	r := handler.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, end := StartSpan(r.Context(), "client")
+		defer end()
+		outgoing = http.Header{}
+		InjectHeaders(ctx, outgoing)
+	}))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req.Header.Set(TracestateHeader, "vendor=value")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	traceID, spanID, _, err := ParseTraceparent(w.Header().Get(TraceresponseHeader))
+	if err != nil || traceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Error("响应头中的trace id错误")
+	}
+	if spanID.String() == "00f067aa0ba902b7" {
+		t.Error("响应头中应该是本服务的span id")
+	}
+
+	outTraceID, outSpanID, _, err := ParseTraceparent(outgoing.Get(TraceparentHeader))
+	if err != nil || outTraceID != traceID {
+		t.Error("出站请求没有携带相同的trace id")
+	}
+	if outSpanID == spanID || !outSpanID.IsValid() {
+		t.Error("出站请求的父节点应该是client节点")
+	}
+	if outgoing.Get(TracestateHeader) != "vendor=value" {
+		t.Error("tracestate没有传递")
+	}
+}
+
+func TestTraceIDGenerated(t *testing.T) {
+	trace := NewTrace("GET /")
+	trace.extract(http.Header{})
+	if !trace.TraceID().IsValid() || !trace.SpanID().IsValid() || trace.ParentSpanID().IsValid() {
+		t.Error("没有traceparent时应该生成新的trace id")
+	}
+	if !strings.HasPrefix(trace.Traceparent(), "00-"+trace.TraceID().String()) {
+		t.Error("traceparent格式错误")
+	}
+
+	handler := &LocalTracing{Logger: zap.NewNop()}
+	if handler.WithContext(NewContext(context.Background(), trace)) == handler.Logger {
+		t.Error("WithContext没有添加trace字段")
+	}
+}
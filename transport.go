@@ -0,0 +1,50 @@
+package localtracing
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Transport 记录出站请求的http.RoundTripper
+// 每次请求作为当前请求调用树的子节点，记录method、host、状态码、耗时以及错误，并携带traceparent请求头
+//
+//	client := &http.Client{Transport: &localtracing.Transport{}}
+//	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+type Transport struct {
+	Base http.RoundTripper // 为nil时使用http.DefaultTransport
+}
+
+func (t *Transport) base() http.RoundTripper {
+	if t.Base != nil {
+		return t.Base
+	}
+	return http.DefaultTransport
+}
+
+// RoundTrip 耗时记录到收到响应头为止
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, op := StartOperation(req.Context(), fmt.Sprintf("HTTP %s %s", req.Method, req.URL.Host))
+	if op == nil {
+		return t.base().RoundTrip(req)
+	}
+	defer op.End()
+
+	// RoundTripper不能修改原始请求
+	req = req.Clone(ctx)
+	InjectHeaders(ctx, req.Header)
+	op.SetAttr("http.method", req.Method)
+	op.SetAttr("http.host", req.URL.Host)
+	op.SetAttr("http.path", req.URL.Path)
+
+	resp, err := t.base().RoundTrip(req)
+	if err != nil {
+		op.SetError(err)
+		return resp, err
+	}
+	op.SetAttr("http.status_code", resp.StatusCode)
+	if resp.StatusCode >= 400 {
+		op.SetError(errors.New(resp.Status))
+	}
+	return resp, nil
+}
@@ -0,0 +1,70 @@
+package localtracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTransport(t *testing.T) {
+	var traceparent string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get(TraceparentHeader)
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(404)
+		}
+	}))
+	defer srv.Close()
+
+	trace := NewTrace("GET /client")
+	ctx := NewContext(context.Background(), trace)
+	client := &http.Client{Transport: &Transport{}}
+
+	for _, path := range []string{"/ok", "/missing"} {
+		req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+path, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if req.Header.Get(TraceparentHeader) != "" {
+			t.Error("不应该修改原始请求")
+		}
+	}
+
+	root := trace.Tree()
+	if len(root.Children) != 2 {
+		t.Fatalf("每次出站请求应该是独立的节点: %d", len(root.Children))
+	}
+	ok, missing := root.Children[0], root.Children[1]
+	if ok.Attrs["http.status_code"] != 200 || ok.Attrs["http.method"] != "GET" || ok.Error != "" {
+		t.Errorf("出站请求记录错误: %+v", ok)
+	}
+	if missing.Attrs["http.status_code"] != 404 || missing.Error == "" {
+		t.Errorf("4xx应该记录为错误: %+v", missing)
+	}
+
+	traceID, spanID, _, err := ParseTraceparent(traceparent)
+	if err != nil || traceID != trace.TraceID() || spanID != missing.ID {
+		t.Error("出站请求的traceparent错误")
+	}
+}
+
+func TestTransportError(t *testing.T) {
+	trace := NewTrace("GET /client")
+	ctx := NewContext(context.Background(), trace)
+	client := &http.Client{Transport: &Transport{}}
+
+	req, _ := http.NewRequestWithContext(ctx, "GET", "http://127.0.0.1:1/", nil)
+	if _, err := client.Do(req); err == nil {
+		t.Fatal("应该连接失败")
+	}
+	if span := trace.Tree().Children[0]; span.Error == "" {
+		t.Error("没有记录连接错误")
+	}
+
+	// 没有调用树时直接透传
+	req, _ = http.NewRequest("GET", "http://127.0.0.1:1/", nil)
+	client.Do(req)
+}
@@ -0,0 +1,26 @@
+// 开发模式 页面文件修改后自动刷新 断开后重连成功也刷新(服务重启)
+(function () {
+    var protocol = location.protocol == "https:" ? "wss:" : "ws:"
+    var url = protocol + "//" + location.host + "/view/reload"
+
+    function connect(reconnect) {
+        var connection = new WebSocket(url)
+        connection.onopen = function () {
+            if (reconnect) {
+                location.reload()
+            }
+        }
+        connection.onmessage = function () {
+            location.reload()
+        }
+        connection.onclose = function () {
+            setTimeout(function () {
+                connect(true)
+            }, 1000)
+        }
+    }
+
+    if (window.WebSocket != undefined) {
+        connect(false)
+    }
+})()
@@ -0,0 +1,71 @@
+// 只读的日志查看组件 带行号以及简单的高亮 替代vue-prism-editor 不依赖外部资源
+(function () {
+    var levels = {
+        DEBUG: "log-debug",
+        INFO: "log-info",
+        WARN: "log-warn",
+        WARNING: "log-warn",
+        ERROR: "log-error",
+        DPANIC: "log-error",
+        PANIC: "log-error",
+        FATAL: "log-error",
+    };
+    // 依次匹配: 字符串、日志级别、时间、数字、true/false/null
+    var tokenRe = /("(?:[^"\\]|\\.)*")|\b(DEBUG|INFO|WARN|WARNING|ERROR|DPANIC|PANIC|FATAL)\b|(\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}(?:\.\d+)?(?:Z|[+-]\d{2}:?\d{2})?)|(-?\b\d+(?:\.\d+)?(?:e[+-]?\d+)?\b)|\b(true|false|null)\b/gi;
+
+    function escapeHTML(text) {
+        return text.replace(/&/g, "&amp;").replace(/</g, "&lt;").replace(/>/g, "&gt;");
+    }
+
+    function highlight(line) {
+        var res = "";
+        var last = 0;
+        line.replace(tokenRe, function (match, str, level, time, num, keyword, offset) {
+            res += escapeHTML(line.slice(last, offset));
+            var cls = "log-keyword";
+            if (str) {
+                cls = "log-string";
+            } else if (level) {
+                cls = levels[level.toUpperCase()];
+            } else if (time) {
+                cls = "log-time";
+            } else if (num) {
+                cls = "log-number";
+            }
+            res += '<span class="' + cls + '">' + escapeHTML(match) + "</span>";
+            last = offset + match.length;
+            return match;
+        });
+        return res + escapeHTML(line.slice(last));
+    }
+
+    Vue.component("log-viewer", {
+        props: {
+            lines: { type: Array, default: function () { return []; } },
+            // 滚动到底部时自动跟随新的日志
+            follow: { type: Boolean, default: true },
+        },
+        template:
+            '<div class="log-viewer" ref="box" @scroll="onScroll">' +
+            '<div class="log-line" v-for="(line, i) in lines" :key="i">' +
+            '<span class="log-lineno">{{ i + 1 }}</span>' +
+            '<span class="log-text" v-html="highlight(line)"></span>' +
+            "</div>" +
+            "</div>",
+        data: function () {
+            return { atBottom: true };
+        },
+        updated: function () {
+            if (this.follow && this.atBottom) {
+                this.$refs.box.scrollTop = this.$refs.box.scrollHeight;
+            }
+        },
+        methods: {
+            highlight: highlight,
+            onScroll: function () {
+                var box = this.$refs.box;
+                this.atBottom = box.scrollTop + box.clientHeight >= box.scrollHeight - 20;
+            },
+        },
+    });
+})();
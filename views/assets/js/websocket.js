@@ -1,5 +1,5 @@
 
-function WSClient(url, onmessage) {
+function WSClient(url, onmessage, onclose) {
     if(window.WebSocket != undefined) {    // 检测是否支持websocket
         var connection = new WebSocket(url);
         // readyState为open时触发
@@ -7,8 +7,11 @@ function WSClient(url, onmessage) {
             console.log("Connected to localhost:8080");
         };
         // readyState为close时触发
-        connection.onclose = function wsClose() {
+        connection.onclose = function wsClose(event) {
             console.log("WebSocket is closed")
+            if (onclose != undefined) {
+                onclose(event)
+            }
         };
         // 客户端收到服务端信息触发
         connection.onmessage = onmessage
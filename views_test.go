@@ -0,0 +1,150 @@
+package localtracing
+
+import (
+	"bytes"
+	"context"
+	"io/fs"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 外部地址 包括http(s)、ws(s)以及省略协议的//host 不限于src、href 也包括脚本中拼接的fetch、WebSocket地址
+var externalURL = regexp.MustCompile(`(?i)(\b(https?|wss?):)?//[a-z0-9-]+(\.[a-z0-9-]+)+(:\d+)?`)
+
+// 不会被浏览器请求的地址 key为文件以及匹配到的地址
+var allowedURLs = map[string]string{
+	"views/assets/js/vue.2.6.min.js http://www.w3.org":                   "svg、MathML的命名空间",
+	"views/assets/css/tailwindcss.2.2.9.min.css https://tailwindcss.com": "许可证注释",
+	"views/assets/css/tailwindcss.2.2.9.min.css https://github.com":      "许可证注释",
+}
+
+// 内嵌页面需要在离线环境中使用 不能依赖CDN 检查views下的所有文件
+func TestViewsNoExternalURL(t *testing.T) {
+	err := fs.WalkDir(Views, "views", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(Views, name)
+		if err != nil {
+			return err
+		}
+		for _, url := range externalURL.FindAllString(string(data), -1) {
+			if _, ok := allowedURLs[name+" "+url]; !ok {
+				t.Errorf("%s 引用了外部地址: %s", name, url)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{
+		`<script src="https://unpkg.com/prismjs/prism.js"></script>`,
+		`@import url("//fonts.googleapis.com/css")`,
+		`fetch("https://api.example.com/trace/list")`,
+		`new WebSocket("wss://example.com:8080/view/ws")`,
+		`let cdn = "//cdn.jsdelivr.net/npm/vue"`,
+	} {
+		if !externalURL.MatchString(line) {
+			t.Errorf("没有匹配外部地址: %s", line)
+		}
+	}
+	for _, line := range []string{
+		`<script src="/static/views/assets/js/vue.2.6.min.js"></script>`,
+		`WSClient(protocol + "//" + location.host + "/metrics/latency/data")`,
+		`fetch("/trace/list?" + query)`,
+	} {
+		if externalURL.MatchString(line) {
+			t.Errorf("错误地匹配了本地地址: %s", line)
+		}
+	}
+}
+
+// 开发模式下从磁盘读取页面 文件修改后通知刷新
+func TestDevViews(t *testing.T) {
+	dir, err := ioutil.TempDir("", "views")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "views"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	page := filepath.Join(dir, "views", "trace.html")
+	data, err := fs.ReadFile(Views, "views/trace.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = bytes.Replace(data, []byte("<body"), []byte("<body data-page=\"dev page\""), 1)
+	if err := ioutil.WriteFile(page, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := newTestHandler()
+	if _, err := NewMonitor(mux, "./log", WithDevViews(dir)); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/view/trace", nil))
+	if w.Code != 200 {
+		t.Fatalf("状态码错误: %d %s", w.Code, w.Body.String())
+	}
+	if body := w.Body.String(); !strings.Contains(body, "dev page") || !strings.Contains(body, "livereload.js") {
+		t.Error("没有读取磁盘上的页面")
+	}
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/static/views/trace.html", nil))
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "dev page") {
+		t.Errorf("静态资源没有读取磁盘上的文件: %d", w.Code)
+	}
+	// 项目中views以外的文件不能访问
+	if err := ioutil.WriteFile(filepath.Join(dir, "go.mod"), []byte("module demo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, url := range []string{"/static/go.mod", "/static/views/../go.mod"} {
+		w = httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		if w.Code != 404 {
+			t.Errorf("%s 不应该访问项目文件: %d", url, w.Code)
+		}
+	}
+
+	watcher := newViewWatcher(filepath.Join(dir, "views"), 10*time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := watcher.Subscribe(ctx)
+	time.Sleep(50 * time.Millisecond)
+	if err := ioutil.WriteFile(page, append(data, "\n"...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ch:
+	case <-time.After(2 * time.Second):
+		t.Error("文件修改后没有通知刷新")
+	}
+}
+
+// 内嵌模式下页面不加载自动刷新的脚本
+func TestEmbedViews(t *testing.T) {
+	mux := newTestHandler()
+	if _, err := NewMonitor(mux, "./log"); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/view/latency", nil))
+	if w.Code != 200 || strings.Contains(w.Body.String(), "livereload.js") {
+		t.Errorf("页面渲染错误: %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/static/views/assets/js/vue.2.6.min.js", nil))
+	if w.Code != 200 || w.Body.Len() == 0 {
+		t.Errorf("静态资源错误: %d", w.Code)
+	}
+}